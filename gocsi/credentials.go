@@ -0,0 +1,158 @@
+package gocsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+
+	"golang.org/x/net/context"
+)
+
+// CredentialStore resolves a well-known credential key - typically the
+// value a CO places in a request's UserCredentials map or a
+// `csi.storage.k8s.io/secret` volume attribute - to the actual credential
+// material a ServiceProvider needs to talk to its backend.
+type CredentialStore interface {
+	// Get returns the credential map for key, or an error if no
+	// credential is registered under that key.
+	Get(ctx context.Context, key string) (map[string]string, error)
+}
+
+// FileCredentialStore is a CredentialStore backed by a single JSON file
+// on disk, shaped as `{"key": {"field": "value"}}`. It is the simplest
+// store a plug-in can point at via a mounted Secret volume.
+type FileCredentialStore struct {
+	Path string
+}
+
+// Get implements CredentialStore.
+func (s *FileCredentialStore) Get(
+	ctx context.Context, key string) (map[string]string, error) {
+
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("gocsi: read credential file: %v", err)
+	}
+
+	all := map[string]map[string]string{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("gocsi: parse credential file: %v", err)
+	}
+
+	creds, ok := all[key]
+	if !ok {
+		return nil, fmt.Errorf("gocsi: no credential registered for key %q", key)
+	}
+	return creds, nil
+}
+
+// KubernetesSecretCredentialStore is a CredentialStore backed by
+// Kubernetes Secrets, fetched via a caller-supplied getter so this
+// package doesn't take a hard dependency on client-go. Namespace is
+// fixed at construction; key is treated as the Secret's name.
+type KubernetesSecretCredentialStore struct {
+	Namespace string
+	GetSecret func(ctx context.Context, namespace, name string) (map[string][]byte, error)
+}
+
+// Get implements CredentialStore.
+func (s *KubernetesSecretCredentialStore) Get(
+	ctx context.Context, key string) (map[string]string, error) {
+
+	data, err := s.GetSecret(ctx, s.Namespace, key)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"gocsi: get secret %s/%s: %v", s.Namespace, key, err)
+	}
+
+	creds := make(map[string]string, len(data))
+	for k, v := range data {
+		creds[k] = string(v)
+	}
+	return creds, nil
+}
+
+// CredentialKeyField is the well-known key, present in a request's
+// UserCredentials map or equivalent volume attribute, whose value names
+// the credential to resolve from a CredentialStore.
+const CredentialKeyField = "csi.storage.k8s.io/secret"
+
+type hasUserCredentials interface {
+	GetUserCredentials() map[string]string
+}
+
+// redactedCredentialFields lists the credential fields Redact masks in
+// the logged form of a request's UserCredentials, so a logging
+// interceptor that uses Redact never prints them.
+var redactedCredentialFields = []string{"password", "secretKey", "token"}
+
+// SecretResolver returns an Interceptor that, given a request
+// implementing GetUserCredentials, looks up the credential named by
+// CredentialKeyField in store and replaces the request's
+// UserCredentials map with the resolved material before dispatch. The
+// well-known key field itself is removed from the resolved map so it
+// never leaks downstream as if it were a real credential value.
+func SecretResolver(store CredentialStore) Interceptor {
+	return func(ctx context.Context, rpc string, req interface{}, next Invoker) (interface{}, error) {
+		hc, ok := req.(hasUserCredentials)
+		if !ok {
+			return next(ctx, req)
+		}
+
+		creds := hc.GetUserCredentials()
+		key, ok := creds[CredentialKeyField]
+		if !ok {
+			return next(ctx, req)
+		}
+
+		resolved, err := store.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("gocsi: %s: resolve credentials: %v", rpc, err)
+		}
+
+		delete(resolved, CredentialKeyField)
+		setUserCredentials(req, resolved)
+
+		return next(ctx, req)
+	}
+}
+
+// setUserCredentials assigns resolved to req's exported UserCredentials
+// field via reflection. The protoc-generated CSI request types carry
+// UserCredentials as a plain map[string]string field with no setter
+// method, so there's nothing to type-assert against; reflection is the
+// only way to overwrite it generically across every request type
+// SecretResolver might see.
+func setUserCredentials(req interface{}, resolved map[string]string) {
+	v := reflect.ValueOf(req)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return
+	}
+	v = v.Elem()
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	f := v.FieldByName("UserCredentials")
+	if !f.IsValid() || !f.CanSet() || f.Kind() != reflect.Map {
+		return
+	}
+	f.Set(reflect.ValueOf(resolved).Convert(f.Type()))
+}
+
+// Redact returns a copy of creds with any field named in
+// redactedCredentialFields replaced by "***", for use by logging
+// interceptors that must never print raw credential material.
+func Redact(creds map[string]string) map[string]string {
+	out := make(map[string]string, len(creds))
+	for k, v := range creds {
+		out[k] = v
+	}
+	for _, f := range redactedCredentialFields {
+		if _, ok := out[f]; ok {
+			out[f] = "***"
+		}
+	}
+	return out
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// redactedFieldNames lists the struct field names unaryServerLogging
+// strips from a request/response before logging it, in the spirit of
+// csi-lib-utils/protosanitizer's secret stripping.
+var redactedFieldNames = []string{"UserCredentials", "Secrets"}
+
+// redact returns a shallow copy of msg with any field named in
+// redactedFieldNames replaced by "***", so logging a request/response
+// can never leak a credential verbatim.
+func redact(msg interface{}) interface{} {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return msg
+	}
+
+	cp := reflect.New(v.Elem().Type())
+	cp.Elem().Set(v.Elem())
+
+	for _, name := range redactedFieldNames {
+		f := cp.Elem().FieldByName(name)
+		if !f.IsValid() || !f.CanSet() || f.Kind() != reflect.Map {
+			continue
+		}
+		redacted := reflect.MakeMap(f.Type())
+		for _, k := range f.MapKeys() {
+			redacted.SetMapIndex(k, reflect.ValueOf("***").Convert(f.Type().Elem()))
+		}
+		f.Set(redacted)
+	}
+
+	return cp.Interface()
+}
+
+// unaryServerLogging returns a grpc.UnaryServerInterceptor that logs
+// every unary RPC's method, duration, and resulting status code, along
+// with its sanitized request/response.
+func unaryServerLogging() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+
+		start := time.Now()
+		resp, err := handler(ctx, req)
+
+		log.Printf("%s took %s code=%s request=%+v response=%+v\n",
+			info.FullMethod, time.Since(start), status.Code(err), redact(req), redact(resp))
+
+		return resp, err
+	}
+}
+
+// unaryServerRecovery returns a grpc.UnaryServerInterceptor that
+// recovers a panicking handler, logs the panic value and a stack trace,
+// and turns it into a codes.Internal error rather than crashing the
+// process and taking down every other in-flight RPC with it.
+func unaryServerRecovery() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (resp interface{}, err error) {
+
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("panic handling %s: %v\n%s", info.FullMethod, r, debug.Stack())
+				err = status.Error(codes.Internal, fmt.Sprintf("panic: %v", r))
+			}
+		}()
+
+		return handler(ctx, req)
+	}
+}
+
+// chainUnaryInterceptors composes interceptors into a single
+// grpc.UnaryServerInterceptor that invokes them in order, each wrapping
+// the next, with handler as the innermost call.
+func chainUnaryInterceptors(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			ic, cur := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return ic(ctx, req, info, cur)
+			}
+		}
+		return next(ctx, req)
+	}
+}
+
+// awsErrToStatus translates an AWS error into the gRPC status a CSI
+// conformance suite expects, so handlers don't each reinvent the
+// mapping from EC2 error codes to canonical codes.Code values.
+func awsErrToStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	switch {
+	case strings.HasSuffix(aerr.Code(), ".NotFound"):
+		return status.Error(codes.NotFound, aerr.Message())
+	case strings.EqualFold(aerr.Code(), "VolumeInUse"):
+		return status.Error(codes.FailedPrecondition, aerr.Message())
+	case strings.EqualFold(aerr.Code(), "IncorrectState"):
+		return status.Error(codes.FailedPrecondition, aerr.Message())
+	case strings.EqualFold(aerr.Code(), "RequestLimitExceeded"),
+		strings.Contains(aerr.Code(), "Throttling"):
+		return status.Error(codes.Unavailable, aerr.Message())
+	case strings.HasPrefix(aerr.Code(), "Invalid") || strings.HasPrefix(aerr.Code(), "Unsupported"):
+		return status.Error(codes.InvalidArgument, aerr.Message())
+	default:
+		return status.Error(codes.Internal, fmt.Sprintf("%s: %s", aerr.Code(), aerr.Message()))
+	}
+}
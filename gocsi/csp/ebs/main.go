@@ -4,6 +4,8 @@ import "C"
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,17 +13,21 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -74,6 +80,9 @@ type sp struct {
 	server *grpc.Server
 	closed bool
 	client *ec2.EC2
+
+	scopedClientsMu sync.RWMutex
+	scopedClients   map[string]*ec2.EC2
 }
 
 // ServiceProvider.Serve
@@ -88,7 +97,12 @@ func (s *sp) Serve(ctx context.Context, li net.Listener) error {
 		if s.server != nil {
 			return errServerStarted
 		}
-		s.server = grpc.NewServer()
+		s.server = grpc.NewServer(grpc.UnaryInterceptor(chainUnaryInterceptors(
+			[]grpc.UnaryServerInterceptor{
+				unaryServerRecovery(),
+				unaryServerLogging(),
+			},
+		)))
 		return nil
 	}(); err != nil {
 		return errServerStarted
@@ -117,6 +131,7 @@ func (s *sp) Serve(ctx context.Context, li net.Listener) error {
 		config.Endpoint = aws.String(v)
 	}
 	s.client = ec2.New(sess, config)
+	s.scopedClients = map[string]*ec2.EC2{}
 	log.Println("aws initialized")
 
 	// start the grpc server
@@ -163,10 +178,12 @@ func (s *sp) CreateVolume(
 	req *csi.CreateVolumeRequest) (
 	*csi.CreateVolumeResponse, error) {
 
-	s.Lock()
-	defer s.Unlock()
-
 	name := req.GetName()
+	if !volLocks.TryAcquire(name) {
+		return nil, status.Error(codes.Aborted, "operation pending for volume")
+	}
+	defer volLocks.Release(name)
+
 	in := &ec2.CreateVolumeInput{}
 
 	// set the volume size
@@ -196,9 +213,7 @@ func (s *sp) CreateVolume(
 		if strings.EqualFold(k, "iops") {
 			i, err := strconv.ParseInt(v, 10, 64)
 			if err != nil {
-				// INVALID_PARAMETER_VALUE
-				return ErrCreateVolume(
-					7, fmt.Sprintf("invalid iops: %+v", v)), nil
+				return nil, status.Errorf(codes.InvalidArgument, "invalid iops: %+v", v)
 			}
 			in.Iops = aws.Int64(i)
 			continue
@@ -237,14 +252,26 @@ func (s *sp) CreateVolume(
 		}
 	}
 
+	// a VolumeContentSource snapshot takes precedence over the
+	// snapshotid parameter, restoring the new volume from it
+	if src := req.GetVolumeContentSource().GetSnapshot(); src != nil {
+		if snapID := src.GetId(); snapID != "" {
+			in.SnapshotId = aws.String(snapID)
+		}
+	}
+
 	// availability zone is required
 	if in.AvailabilityZone == nil {
-		// INVALID_VOLUME_NAME
-		return ErrCreateVolume(3, "missing availability zone"), nil
+		return nil, status.Error(codes.InvalidArgument, "missing availability zone")
+	}
+
+	client, err := s.clientFor(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	// check to see if the volume already exists
-	xvols, err := s.client.DescribeVolumes(&ec2.DescribeVolumesInput{
+	xvols, err := client.DescribeVolumes(&ec2.DescribeVolumesInput{
 		Filters: []*ec2.Filter{
 			&ec2.Filter{
 				Name:   aws.String("availability-zone"),
@@ -256,9 +283,7 @@ func (s *sp) CreateVolume(
 			},
 		}})
 	if err != nil {
-		// UNDEFINED
-		return ErrCreateVolumeGeneral(
-			1, fmt.Sprintf("error: ebs xvol check failed: %+v", err)), nil
+		return nil, awsErrToStatus(err)
 	}
 
 	var volume *ec2.Volume
@@ -267,12 +292,9 @@ func (s *sp) CreateVolume(
 		volume = xvols.Volumes[0]
 	} else {
 		// create a new volume
-		nvol, err := s.client.CreateVolume(in)
+		nvol, err := client.CreateVolume(in)
 		if err != nil {
-			// UNDEFINED
-			return ErrCreateVolumeGeneral(
-				1, fmt.Sprintf(
-					"error: ebs create volume failed: %+v", err)), nil
+			return nil, awsErrToStatus(err)
 		}
 
 		// tag the volume with the tags array as well as the
@@ -281,15 +303,11 @@ func (s *sp) CreateVolume(
 			Key:   aws.String("Name"),
 			Value: aws.String(name),
 		})
-		if _, err := s.client.CreateTags(&ec2.CreateTagsInput{
+		if _, err := client.CreateTags(&ec2.CreateTagsInput{
 			Resources: []*string{nvol.VolumeId},
 			Tags:      tags,
 		}); err != nil {
-			// UNDEFINED
-			return ErrCreateVolumeGeneral(
-				1, fmt.Sprintf(
-					"error: volume: %s: tag volume failed: %+v",
-					*nvol.VolumeId, err)), nil
+			return nil, awsErrToStatus(err)
 		}
 		nvol.Tags = tags
 		// assign the new volume
@@ -312,35 +330,24 @@ func (s *sp) DeleteVolume(
 
 	id, ok := req.GetVolumeId().GetValues()["id"]
 	if !ok {
-		// INVALID_VOLUME_ID
-		return ErrDeleteVolume(3, "missing id val"), nil
+		return nil, status.Error(codes.InvalidArgument, "missing id val")
 	}
 
-	s.Lock()
-	defer s.Unlock()
-
-	_, err := s.client.DeleteVolume(&ec2.DeleteVolumeInput{
-		VolumeId: aws.String(id),
-	})
+	if !volLocks.TryAcquire(id) {
+		return nil, status.Error(codes.Aborted, "operation pending for volume")
+	}
+	defer volLocks.Release(id)
 
-	if aerr, ok := err.(awserr.Error); ok {
-		msg := fmt.Sprintf(
-			"error: awserr: %s: %s", aerr.Code(), aerr.Message())
-		if strings.EqualFold(aerr.Code(), msg) {
-			// VOLUME_DOES_NOT_EXIST
-			return ErrDeleteVolume(5, msg), nil
-		}
-		// UNDEFINED
-		return ErrDeleteVolumeGeneral(1, msg), nil
+	client, err := s.clientFor(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	// InvalidVolume.NotFound
 
+	_, err = client.DeleteVolume(&ec2.DeleteVolumeInput{
+		VolumeId: aws.String(id),
+	})
 	if err != nil {
-		// UNDEFINED
-		return ErrDeleteVolumeGeneral(
-			1, fmt.Sprintf(
-				"error: volume: %s: delete failed: %+v",
-				id, err)), nil
+		return nil, awsErrToStatus(err)
 	}
 
 	return &csi.DeleteVolumeResponse{
@@ -357,38 +364,112 @@ func (s *sp) ControllerPublishVolume(
 
 	id, ok := req.GetVolumeId().GetValues()["id"]
 	if !ok {
-		// INVALID_VOLUME_ID
-		return ErrControllerPublishVolume(3, "missing id val"), nil
+		return nil, status.Error(codes.InvalidArgument, "missing id val")
 	}
 
 	nid := req.GetNodeId()
 	if nid == nil {
-		// INVALID_NODE_ID
-		return ErrControllerPublishVolume(7, "missing node id"), nil
+		return nil, status.Error(codes.InvalidArgument, "missing node id")
 	}
 
 	nidv := nid.GetValues()
 	if len(nidv) == 0 {
-		// INVALID_NODE_ID
-		return ErrControllerPublishVolume(7, "missing node id"), nil
+		return nil, status.Error(codes.InvalidArgument, "missing node id")
 	}
 
-	nidid, ok := nidv["id"]
+	instanceID, ok := nidv["instanceID"]
 	if !ok {
-		// INVALID_NODE_ID
-		return ErrControllerPublishVolume(7, "node id required"), nil
+		return nil, status.Error(codes.InvalidArgument, "node id required")
 	}
-	_ = id
-	_ = nidid
 
-	s.Lock()
-	defer s.Unlock()
+	if !volLocks.TryAcquire(id) {
+		return nil, status.Error(codes.Aborted, "operation pending for volume")
+	}
+	defer volLocks.Release(id)
+
+	client, err := s.clientFor(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	xvols, err := client.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return nil, awsErrToStatus(err)
+	}
+	if len(xvols.Volumes) == 0 {
+		return nil, status.Error(codes.NotFound, "volume does not exist")
+	}
+	volume := xvols.Volumes[0]
+
+	if _, err := client.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	}); err != nil {
+		return nil, awsErrToStatus(err)
+	}
+
+	// a volume already attached elsewhere can't be published again
+	// unless the attachment is to this same instance, in which case
+	// the existing device is simply returned.
+	for _, a := range volume.Attachments {
+		if a.InstanceId == nil || a.State == nil || *a.State == "detached" {
+			continue
+		}
+		if *a.InstanceId == instanceID {
+			return &csi.ControllerPublishVolumeResponse{
+				Reply: &csi.ControllerPublishVolumeResponse_Result_{
+					Result: &csi.ControllerPublishVolumeResponse_Result{
+						PublishVolumeInfo: &csi.PublishVolumeInfo{
+							Values: map[string]string{
+								"devicePath": *a.Device,
+								"readonly":   strconv.FormatBool(req.GetReadonly()),
+							},
+						},
+					},
+				},
+			}, nil
+		}
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"volume already published to node %s", *a.InstanceId)
+	}
+
+	// allocateDeviceName's describe-then-pick is not atomic against EC2,
+	// so two ControllerPublishVolume calls attaching different volumes
+	// to the same instance must not run it concurrently or they can
+	// both see the same device letter free and race AttachVolume with
+	// it. instanceLocks serializes that sequence per instance, on top
+	// of volLocks' per-volume serialization above.
+	if !instanceLocks.TryAcquire(instanceID) {
+		return nil, status.Error(codes.Aborted, "operation pending for instance")
+	}
+	defer instanceLocks.Release(instanceID)
+
+	device, err := allocateDeviceName(client, instanceID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if _, err := client.AttachVolume(&ec2.AttachVolumeInput{
+		VolumeId:   aws.String(id),
+		InstanceId: aws.String(instanceID),
+		Device:     aws.String(device),
+	}); err != nil {
+		return nil, awsErrToStatus(err)
+	}
+
+	if err := waitForVolumeState(client, id, "attached"); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
 	return &csi.ControllerPublishVolumeResponse{
 		Reply: &csi.ControllerPublishVolumeResponse_Result_{
 			Result: &csi.ControllerPublishVolumeResponse_Result{
 				PublishVolumeInfo: &csi.PublishVolumeInfo{
-					Values: map[string]string{},
+					Values: map[string]string{
+						"devicePath": device,
+						"readonly":   strconv.FormatBool(req.GetReadonly()),
+					},
 				},
 			},
 		},
@@ -402,33 +483,45 @@ func (s *sp) ControllerUnpublishVolume(
 
 	id, ok := req.GetVolumeId().GetValues()["id"]
 	if !ok {
-		// INVALID_VOLUME_ID
-		return ErrControllerUnpublishVolume(3, "missing id val"), nil
+		return nil, status.Error(codes.InvalidArgument, "missing id val")
 	}
 
 	nid := req.GetNodeId()
 	if nid == nil {
-		// INVALID_NODE_ID
-		return ErrControllerUnpublishVolume(7, "missing node id"), nil
+		return nil, status.Error(codes.InvalidArgument, "missing node id")
 	}
 
 	nidv := nid.GetValues()
 	if len(nidv) == 0 {
-		// INVALID_NODE_ID
-		return ErrControllerUnpublishVolume(7, "missing node id"), nil
+		return nil, status.Error(codes.InvalidArgument, "missing node id")
 	}
 
-	nidid, ok := nidv["id"]
+	instanceID, ok := nidv["instanceID"]
 	if !ok {
-		// NODE_ID_REQUIRED
-		return ErrControllerUnpublishVolume(9, "node id required"), nil
+		return nil, status.Error(codes.InvalidArgument, "node id required")
 	}
 
-	_ = id
-	_ = nidid
+	if !volLocks.TryAcquire(id) {
+		return nil, status.Error(codes.Aborted, "operation pending for volume")
+	}
+	defer volLocks.Release(id)
 
-	s.Lock()
-	defer s.Unlock()
+	client, err := s.clientFor(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	_, err = client.DetachVolume(&ec2.DetachVolumeInput{
+		VolumeId:   aws.String(id),
+		InstanceId: aws.String(instanceID),
+	})
+	if err != nil {
+		return nil, awsErrToStatus(err)
+	}
+
+	if err := waitForVolumeState(client, id, "available"); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
 	return &csi.ControllerUnpublishVolumeResponse{
 		Reply: &csi.ControllerUnpublishVolumeResponse_Result_{
@@ -450,9 +543,6 @@ func (s *sp) ListVolumes(
 	req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse, error) {
 
-	s.Lock()
-	defer s.Unlock()
-
 	in := &ec2.DescribeVolumesInput{}
 	if v := req.GetMaxEntries(); v > 0 {
 		in.MaxResults = aws.Int64(int64(v))
@@ -463,8 +553,7 @@ func (s *sp) ListVolumes(
 
 	out, err := s.client.DescribeVolumes(in)
 	if err != nil {
-		// UNDEFINED
-		return ErrListVolumes(1, err.Error()), nil
+		return nil, awsErrToStatus(err)
 	}
 
 	entries := make([]*csi.ListVolumesResponse_Result_Entry, len(out.Volumes))
@@ -503,6 +592,166 @@ func (s *sp) GetCapacity(
 	}, nil
 }
 
+func (s *sp) CreateSnapshot(
+	ctx context.Context,
+	req *csi.CreateSnapshotRequest) (
+	*csi.CreateSnapshotResponse, error) {
+
+	name := req.GetName()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing name")
+	}
+
+	srcID, ok := req.GetSourceVolumeId().GetValues()["id"]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "missing source volume id")
+	}
+
+	if !volLocks.TryAcquire(name) {
+		return nil, status.Error(codes.Aborted, "operation pending for snapshot")
+	}
+	defer volLocks.Release(name)
+
+	client, err := s.clientFor(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// idempotent: a snapshot already tagged with this name is returned
+	// as-is rather than creating a duplicate.
+	xsnaps, err := client.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("volume-id"),
+				Values: []*string{aws.String(srcID)},
+			},
+			&ec2.Filter{
+				Name:   aws.String("tag:Name"),
+				Values: []*string{aws.String(name)},
+			},
+		},
+	})
+	if err != nil {
+		return nil, awsErrToStatus(err)
+	}
+
+	var snapshot *ec2.Snapshot
+
+	if len(xsnaps.Snapshots) > 0 {
+		snapshot = xsnaps.Snapshots[0]
+	} else {
+		nsnap, err := client.CreateSnapshot(&ec2.CreateSnapshotInput{
+			VolumeId: aws.String(srcID),
+		})
+		if err != nil {
+			return nil, awsErrToStatus(err)
+		}
+
+		if _, err := client.CreateTags(&ec2.CreateTagsInput{
+			Resources: []*string{nsnap.SnapshotId},
+			Tags: []*ec2.Tag{
+				&ec2.Tag{
+					Key:   aws.String("Name"),
+					Value: aws.String(name),
+				},
+			},
+		}); err != nil {
+			return nil, awsErrToStatus(err)
+		}
+		snapshot = nsnap
+	}
+
+	return &csi.CreateSnapshotResponse{
+		Reply: &csi.CreateSnapshotResponse_Result_{
+			Result: &csi.CreateSnapshotResponse_Result{
+				Snapshot: toSnapshotInfo(snapshot),
+			},
+		},
+	}, nil
+}
+
+func (s *sp) DeleteSnapshot(
+	ctx context.Context,
+	req *csi.DeleteSnapshotRequest) (
+	*csi.DeleteSnapshotResponse, error) {
+
+	id := req.GetSnapshotId()
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing snapshot id")
+	}
+
+	if !volLocks.TryAcquire(id) {
+		return nil, status.Error(codes.Aborted, "operation pending for snapshot")
+	}
+	defer volLocks.Release(id)
+
+	client, err := s.clientFor(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	_, err = client.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+		SnapshotId: aws.String(id),
+	})
+	if err != nil {
+		return nil, awsErrToStatus(err)
+	}
+
+	return &csi.DeleteSnapshotResponse{
+		Reply: &csi.DeleteSnapshotResponse_Result_{
+			Result: &csi.DeleteSnapshotResponse_Result{},
+		},
+	}, nil
+}
+
+func (s *sp) ListSnapshots(
+	ctx context.Context,
+	req *csi.ListSnapshotsRequest) (
+	*csi.ListSnapshotsResponse, error) {
+
+	in := &ec2.DescribeSnapshotsInput{}
+	if v := req.GetMaxEntries(); v > 0 {
+		in.MaxResults = aws.Int64(int64(v))
+	}
+	if v := req.GetStartingToken(); len(v) > 0 {
+		in.NextToken = aws.String(v)
+	}
+	if v := req.GetSourceVolumeId(); v != "" {
+		in.Filters = []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("volume-id"),
+				Values: []*string{aws.String(v)},
+			},
+		}
+	}
+
+	out, err := s.client.DescribeSnapshots(in)
+	if err != nil {
+		return nil, awsErrToStatus(err)
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Result_Entry, len(out.Snapshots))
+	for x, snapshot := range out.Snapshots {
+		entries[x] = &csi.ListSnapshotsResponse_Result_Entry{
+			Snapshot: toSnapshotInfo(snapshot),
+		}
+	}
+
+	var nextToken string
+	if v := out.NextToken; v != nil {
+		nextToken = *v
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Reply: &csi.ListSnapshotsResponse_Result_{
+			Result: &csi.ListSnapshotsResponse_Result{
+				Entries:   entries,
+				NextToken: nextToken,
+			},
+		},
+	}, nil
+}
+
 func (s *sp) ControllerGetCapabilities(
 	ctx context.Context,
 	req *csi.ControllerGetCapabilitiesRequest) (
@@ -544,6 +793,22 @@ func (s *sp) ControllerGetCapabilities(
 							},
 						},
 					},
+					&csi.ControllerServiceCapability{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								// CREATE_DELETE_SNAPSHOT
+								Type: 5,
+							},
+						},
+					},
+					&csi.ControllerServiceCapability{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								// LIST_SNAPSHOTS_AND_PROVISIONABLE
+								Type: 6,
+							},
+						},
+					},
 				},
 			},
 		},
@@ -594,6 +859,89 @@ func (s *sp) GetPluginInfo(
 //                                Node Service                                //
 ////////////////////////////////////////////////////////////////////////////////
 
+// NodeStageVolume formats (if needed) and mounts id's attached device
+// onto StagingTargetPath, the single node-global mount that
+// NodePublishVolume then bind-mounts into each pod sharing the volume.
+// A Block volume capability has nothing to format or mount here; the
+// raw device is bind-mounted directly by NodePublishVolume instead.
+func (s *sp) NodeStageVolume(
+	ctx context.Context,
+	req *csi.NodeStageVolumeRequest) (
+	*csi.NodeStageVolumeResponse, error) {
+
+	id, ok := req.GetVolumeId().GetValues()["id"]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "missing id val")
+	}
+
+	target := req.GetStagingTargetPath()
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing staging target path")
+	}
+
+	if !volLocks.TryAcquire(id) {
+		return nil, status.Error(codes.Aborted, "operation pending for volume")
+	}
+	defer volLocks.Release(id)
+
+	mount := req.GetVolumeCapability().GetMount()
+	if mount == nil {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	iid, err := instanceIdentity()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	device, err := deviceForVolume(s.client, iid.InstanceID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := formatDevice(device, mount.GetFsType()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := mountDevice(device, target, mount.GetFsType(), mount.GetMountFlags()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume unmounts id's StagingTargetPath, idempotently:
+// a path that's already unmounted is treated as success.
+func (s *sp) NodeUnstageVolume(
+	ctx context.Context,
+	req *csi.NodeUnstageVolumeRequest) (
+	*csi.NodeUnstageVolumeResponse, error) {
+
+	id, ok := req.GetVolumeId().GetValues()["id"]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "missing id val")
+	}
+
+	target := req.GetStagingTargetPath()
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing staging target path")
+	}
+
+	if !volLocks.TryAcquire(id) {
+		return nil, status.Error(codes.Aborted, "operation pending for volume")
+	}
+	defer volLocks.Release(id)
+
+	if err := unmount(target); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume bind-mounts the volume into TargetPath: from the
+// node-global StagingTargetPath for a Mount capability, or directly
+// from the attached raw device for a Block capability.
 func (s *sp) NodePublishVolume(
 	ctx context.Context,
 	req *csi.NodePublishVolumeRequest) (
@@ -601,14 +949,41 @@ func (s *sp) NodePublishVolume(
 
 	id, ok := req.GetVolumeId().GetValues()["id"]
 	if !ok {
-		// MISSING_REQUIRED_FIELD
-		return ErrNodePublishVolumeGeneral(3, "missing id val"), nil
+		return nil, status.Error(codes.InvalidArgument, "missing id val")
 	}
 
-	s.Lock()
-	defer s.Unlock()
+	target := req.GetTargetPath()
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing target path")
+	}
+
+	if !volLocks.TryAcquire(id) {
+		return nil, status.Error(codes.Aborted, "operation pending for volume")
+	}
+	defer volLocks.Release(id)
+
+	var source string
+	if req.GetVolumeCapability().GetBlock() != nil {
+		iid, err := instanceIdentity()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 
-	_ = id
+		device, err := deviceForVolume(s.client, iid.InstanceID, id)
+		if err != nil {
+			return nil, err
+		}
+		source = device
+	} else {
+		source = req.GetStagingTargetPath()
+		if source == "" {
+			return nil, status.Error(codes.InvalidArgument, "missing staging target path")
+		}
+	}
+
+	if err := bindMount(source, target, req.GetReadonly()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
 	return &csi.NodePublishVolumeResponse{
 		Reply: &csi.NodePublishVolumeResponse_Result_{
@@ -617,21 +992,34 @@ func (s *sp) NodePublishVolume(
 	}, nil
 }
 
+// NodeUnpublishVolume unmounts id's TargetPath and removes it,
+// idempotently: a path that's already unmounted is treated as success.
 func (s *sp) NodeUnpublishVolume(
 	ctx context.Context,
 	req *csi.NodeUnpublishVolumeRequest) (
 	*csi.NodeUnpublishVolumeResponse, error) {
 
-	s.Lock()
-	defer s.Unlock()
-
 	id, ok := req.GetVolumeId().GetValues()["id"]
 	if !ok {
-		// VOLUME_DOES_NOT_EXIST
-		return ErrNodeUnpublishVolume(2, "missing id val"), nil
+		return nil, status.Error(codes.InvalidArgument, "missing id val")
+	}
+
+	target := req.GetTargetPath()
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing target path")
 	}
 
-	_ = id
+	if !volLocks.TryAcquire(id) {
+		return nil, status.Error(codes.Aborted, "operation pending for volume")
+	}
+	defer volLocks.Release(id)
+
+	if err := unmount(target); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
 	return &csi.NodeUnpublishVolumeResponse{
 		Reply: &csi.NodeUnpublishVolumeResponse_Result_{
@@ -649,30 +1037,36 @@ type instanceIdentityDoc struct {
 	AvailabilityZone string `json:"availabilityZone,omitempty"`
 }
 
-func (s *sp) GetNodeID(
-	ctx context.Context,
-	req *csi.GetNodeIDRequest) (
-	*csi.GetNodeIDResponse, error) {
-
+// instanceIdentity fetches and decodes this node's instance identity
+// document from the metadata service, the source of truth GetNodeID
+// and the Node RPCs use to learn which EC2 instance they're running on.
+func instanceIdentity() (*instanceIdentityDoc, error) {
 	hreq, err := http.NewRequest(http.MethodGet, iidURL, nil)
 	if err != nil {
-		// UNDEFINED
-		return ErrGetNodeIDGeneral(1, err.Error()), nil
+		return nil, err
 	}
 
 	hres, err := http.DefaultClient.Do(hreq)
 	if err != nil {
-		// UNDEFINED
-		return ErrGetNodeIDGeneral(1, err.Error()), nil
+		return nil, err
 	}
-
 	defer hres.Body.Close()
 
-	iid := instanceIdentityDoc{}
-	dec := json.NewDecoder(hres.Body)
-	if err := dec.Decode(&iid); err != nil {
-		// UNDEFINED
-		return ErrGetNodeIDGeneral(1, err.Error()), nil
+	iid := &instanceIdentityDoc{}
+	if err := json.NewDecoder(hres.Body).Decode(iid); err != nil {
+		return nil, err
+	}
+	return iid, nil
+}
+
+func (s *sp) GetNodeID(
+	ctx context.Context,
+	req *csi.GetNodeIDRequest) (
+	*csi.GetNodeIDResponse, error) {
+
+	iid, err := instanceIdentity()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	return &csi.GetNodeIDResponse{
@@ -727,6 +1121,14 @@ func (s *sp) NodeGetCapabilities(
 							},
 						},
 					},
+					&csi.NodeServiceCapability{
+						Type: &csi.NodeServiceCapability_Rpc{
+							Rpc: &csi.NodeServiceCapability_RPC{
+								// STAGE_UNSTAGE_VOLUME
+								Type: 1,
+							},
+						},
+					},
 				},
 			},
 		},
@@ -746,6 +1148,225 @@ const (
 	tib100 uint64 = tib * 100
 )
 
+// clientFor returns the *ec2.EC2 to use for a request carrying secrets:
+// s.client, the instance-wide default built in Serve, when secrets is
+// empty, otherwise a client scoped to the credentials it carries,
+// cached by a hash of that credential material so repeated calls for
+// the same tenant don't re-resolve/re-authenticate every time.
+func (s *sp) clientFor(secrets map[string]string) (*ec2.EC2, error) {
+	if len(secrets) == 0 {
+		return s.client, nil
+	}
+
+	key := secretsCacheKey(secrets)
+
+	s.scopedClientsMu.RLock()
+	c, ok := s.scopedClients[key]
+	s.scopedClientsMu.RUnlock()
+	if ok {
+		return c, nil
+	}
+
+	c, err := newScopedClient(secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	s.scopedClientsMu.Lock()
+	s.scopedClients[key] = c
+	s.scopedClientsMu.Unlock()
+
+	return c, nil
+}
+
+// newScopedClient builds an *ec2.EC2 authenticated from a CSI Secrets
+// map's access_key_id/secret_access_key/session_token, optionally
+// assuming assume_role_arn, and scoped to region if given.
+func newScopedClient(secrets map[string]string) (*ec2.EC2, error) {
+	akid := secrets["access_key_id"]
+	secret := secrets["secret_access_key"]
+	if akid == "" || secret == "" {
+		return nil, errors.New(
+			"secrets: access_key_id and secret_access_key are required")
+	}
+
+	config := &aws.Config{
+		Credentials: credentials.NewStaticCredentials(
+			akid, secret, secrets["session_token"]),
+	}
+	if v := secrets["region"]; v != "" {
+		config.Region = aws.String(v)
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: new session failed: %+v", err)
+	}
+
+	if arn := secrets["assume_role_arn"]; arn != "" {
+		config.Credentials = stscreds.NewCredentials(sess, arn)
+	}
+
+	return ec2.New(sess, config), nil
+}
+
+// secretsCacheKey hashes secrets' sorted key=value pairs so a scoped
+// client can be cached/reused without ever storing the raw credentials
+// as a map key.
+func secretsCacheKey(secrets map[string]string) string {
+	keys := make([]string, 0, len(secrets))
+	for k := range secrets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, secrets[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// volLocks tracks volume names/ids with an operation in flight, so a
+// slow AWS call against one EBS volume can't stall an unrelated
+// volume's RPC behind sp's single mutex.
+var volLocks = newVolumeLocks()
+
+// instanceLocks tracks EC2 instance ids with a device-name allocation in
+// flight, serializing allocateDeviceName's describe-then-pick against
+// AttachVolume across ControllerPublishVolume calls that target
+// different volumes but the same instance.
+var instanceLocks = newVolumeLocks()
+
+// VolumeLocks stores the set of volume names/ids with an operation
+// currently in flight.
+type VolumeLocks struct {
+	mu  sync.Mutex
+	ids map[string]struct{}
+}
+
+func newVolumeLocks() *VolumeLocks {
+	return &VolumeLocks{ids: map[string]struct{}{}}
+}
+
+// TryAcquire reports whether id has no operation in flight and, if so,
+// marks it as locked.
+func (l *VolumeLocks) TryAcquire(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.ids[id]; ok {
+		return false
+	}
+	l.ids[id] = struct{}{}
+	return true
+}
+
+// Release clears id's in-flight operation.
+func (l *VolumeLocks) Release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.ids, id)
+}
+
+// deviceNameLetters is the range of device-name suffixes this driver
+// allocates when attaching a volume, avoiding xvda which is reserved
+// for the instance's root device.
+const deviceNameLetters = "bcdefghijklmnopqrstuvwxyz"
+
+// allocateDeviceName picks the first /dev/xvd* device name not already
+// in use by a volume attached to instanceID.
+func allocateDeviceName(client *ec2.EC2, instanceID string) (string, error) {
+	out, err := client.DescribeVolumes(&ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("attachment.instance-id"),
+				Values: []*string{aws.String(instanceID)},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error: ebs list attached volumes failed: %+v", err)
+	}
+
+	used := map[string]bool{}
+	for _, v := range out.Volumes {
+		for _, a := range v.Attachments {
+			if a.Device != nil {
+				used[*a.Device] = true
+			}
+		}
+	}
+
+	for _, l := range deviceNameLetters {
+		dev := fmt.Sprintf("/dev/xvd%c", l)
+		if !used[dev] {
+			return dev, nil
+		}
+	}
+
+	return "", errors.New("error: no free device names available on instance " + instanceID)
+}
+
+// waitForVolumeState polls DescribeVolumes for id until its state
+// matches want, giving up after a fixed number of attempts since
+// AttachVolume/DetachVolume are asynchronous operations.
+func waitForVolumeState(client *ec2.EC2, id, want string) error {
+	for i := 0; i < 60; i++ {
+		out, err := client.DescribeVolumes(&ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(id)},
+		})
+		if err != nil {
+			return fmt.Errorf("error: ebs describe volume failed: %+v", err)
+		}
+		if len(out.Volumes) == 0 {
+			return fmt.Errorf("error: volume %s not found while waiting for state %s", id, want)
+		}
+
+		volume := out.Volumes[0]
+		switch want {
+		case "attached":
+			for _, a := range volume.Attachments {
+				if a.State != nil && *a.State == "attached" {
+					return nil
+				}
+			}
+		case "available":
+			if volume.State != nil && *volume.State == "available" {
+				return nil
+			}
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	return fmt.Errorf("error: timed out waiting for volume %s to reach state %s", id, want)
+}
+
+// deviceForVolume returns the kernel device path id is attached to on
+// instanceID, as recorded in EBS's own attachment metadata, so the
+// Node RPCs don't have to trust a device path echoed back by the
+// client.
+func deviceForVolume(client *ec2.EC2, instanceID, id string) (string, error) {
+	out, err := client.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return "", awsErrToStatus(err)
+	}
+	if len(out.Volumes) == 0 {
+		return "", status.Error(codes.NotFound, "volume does not exist")
+	}
+
+	for _, a := range out.Volumes[0].Attachments {
+		if a.InstanceId != nil && *a.InstanceId == instanceID &&
+			a.State != nil && *a.State == "attached" && a.Device != nil {
+			return *a.Device, nil
+		}
+	}
+
+	return "", status.Errorf(codes.FailedPrecondition, "volume %s is not attached to instance %s", id, instanceID)
+}
+
 func toVolumeInfo(volume *ec2.Volume) *csi.VolumeInfo {
 
 	volInfo := &csi.VolumeInfo{
@@ -819,3 +1440,28 @@ func toVolumeInfo(volume *ec2.Volume) *csi.VolumeInfo {
 
 	return volInfo
 }
+
+// toSnapshotInfo converts an ec2.Snapshot into a csi.SnapshotInfo,
+// deriving Ready from the EBS snapshot reaching the "completed" state.
+func toSnapshotInfo(snapshot *ec2.Snapshot) *csi.SnapshotInfo {
+
+	info := &csi.SnapshotInfo{}
+
+	if v := snapshot.SnapshotId; v != nil {
+		info.Id = *v
+	}
+	if v := snapshot.VolumeId; v != nil {
+		info.SourceVolumeId = *v
+	}
+	if v := snapshot.VolumeSize; v != nil && *v >= 0 {
+		info.SizeBytes = uint64(*v) * gib
+	}
+	if v := snapshot.StartTime; v != nil {
+		info.CreatedAt = (*v).String()
+	}
+	if v := snapshot.State; v != nil {
+		info.Ready = *v == "completed"
+	}
+
+	return info
+}
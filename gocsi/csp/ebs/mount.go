@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// isMounted reports whether target appears as a mountpoint in
+// /proc/self/mountinfo, so NodeUnstageVolume/NodeUnpublishVolume can
+// treat "already unmounted" as success instead of shelling out to
+// umount and parsing its exit code.
+func isMounted(target string) (bool, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false, fmt.Errorf("error: read mountinfo failed: %+v", err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 4 && fields[4] == target {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// blockDeviceFsType returns the filesystem blkid detects on device, or
+// "" if device is unformatted, so formatDevice only runs mkfs once.
+func blockDeviceFsType(device string) (string, error) {
+	out, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", device).CombinedOutput()
+	if err != nil {
+		// blkid exits 2 when the device has no recognized filesystem
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return "", nil
+		}
+		return "", fmt.Errorf("error: blkid %s failed: %+v: %s", device, err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// allowedFsTypes lists the mkfs.<fsType> binaries formatDevice will
+// run, so a VolumeCapability.Mount.FsType from the request can't make
+// it exec an arbitrary binary name.
+var allowedFsTypes = map[string]bool{
+	"ext2": true, "ext3": true, "ext4": true, "xfs": true,
+}
+
+// formatDevice runs mkfs.<fsType> against device unless it's already
+// formatted, defaulting to ext4 the way most CSI node drivers do when
+// VolumeCapability.Mount.FsType is left blank.
+func formatDevice(device, fsType string) error {
+	if fsType == "" {
+		fsType = "ext4"
+	}
+	if !allowedFsTypes[fsType] {
+		return fmt.Errorf("error: unsupported fs type: %s", fsType)
+	}
+
+	existing, err := blockDeviceFsType(device)
+	if err != nil {
+		return err
+	}
+	if existing != "" {
+		return nil
+	}
+
+	if out, err := exec.Command("mkfs."+fsType, device).CombinedOutput(); err != nil {
+		return fmt.Errorf("error: mkfs.%s %s failed: %+v: %s", fsType, device, err, out)
+	}
+	return nil
+}
+
+// mountDevice creates target and mounts device onto it with fsType and
+// flags, the way NodeStageVolume stages a freshly formatted device for
+// later bind-mounting into one or more pods. Already being mounted at
+// target is treated as success, so a retried NodeStageVolume is a
+// no-op rather than stacking a second mount.
+func mountDevice(device, target, fsType string, flags []string) error {
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return fmt.Errorf("error: mkdir %s failed: %+v", target, err)
+	}
+
+	if mounted, err := isMounted(target); err != nil {
+		return err
+	} else if mounted {
+		return nil
+	}
+
+	args := []string{"-t", fsType}
+	if len(flags) > 0 {
+		args = append(args, "-o", strings.Join(flags, ","))
+	}
+	args = append(args, device, target)
+
+	if out, err := exec.Command("mount", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error: mount %s %s failed: %+v: %s", device, target, err, out)
+	}
+	return nil
+}
+
+// bindMount bind-mounts source onto target, remounting read-only when
+// readonly is set, so multiple pods on a node can share the single
+// mount NodeStageVolume set up at source. target is created as a
+// directory unless source is a block device, in which case it's
+// created as an empty file the way raw block volumes are published.
+// Already being mounted at target is treated as success, so a retried
+// NodePublishVolume is a no-op rather than stacking a second mount.
+func bindMount(source, target string, readonly bool) error {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("error: stat %s failed: %+v", source, err)
+	}
+
+	if fi.Mode()&os.ModeDevice != 0 {
+		if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+			return fmt.Errorf("error: mkdir %s failed: %+v", filepath.Dir(target), err)
+		}
+		f, err := os.OpenFile(target, os.O_CREATE, 0660)
+		if err != nil && !os.IsExist(err) {
+			return fmt.Errorf("error: create %s failed: %+v", target, err)
+		}
+		if f != nil {
+			f.Close()
+		}
+	} else if err := os.MkdirAll(target, 0750); err != nil {
+		return fmt.Errorf("error: mkdir %s failed: %+v", target, err)
+	}
+
+	if mounted, err := isMounted(target); err != nil {
+		return err
+	} else if mounted {
+		return nil
+	}
+
+	if out, err := exec.Command("mount", "--bind", source, target).CombinedOutput(); err != nil {
+		return fmt.Errorf("error: bind mount %s %s failed: %+v: %s", source, target, err, out)
+	}
+
+	if readonly {
+		if out, err := exec.Command("mount", "-o", "remount,bind,ro", target).CombinedOutput(); err != nil {
+			return fmt.Errorf("error: remount %s read-only failed: %+v: %s", target, err, out)
+		}
+	}
+	return nil
+}
+
+// unmount unmounts target, treating it as already unmounted as
+// success, so NodeUnstageVolume/NodeUnpublishVolume are idempotent in
+// the face of a retried RPC.
+func unmount(target string) error {
+	mounted, err := isMounted(target)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		return nil
+	}
+
+	if out, err := exec.Command("umount", target).CombinedOutput(); err != nil {
+		return fmt.Errorf("error: umount %s failed: %+v: %s", target, err, out)
+	}
+	return nil
+}
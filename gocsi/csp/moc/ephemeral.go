@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	rootcsi "github.com/container-storage-interface/examples/gocsi/csi"
+)
+
+// SynthesizeEphemeralVolume and TeardownEphemeralVolume implement
+// gocsi.EphemeralProvider, giving gocsi/sanity's ephemeral NodePublish
+// path a concrete provider to exercise. They're written against the root
+// gocsi/csi package rather than this plug-in's own csp/moc/csi, since
+// that's the type gocsi.Service type-asserts s.sp against in-process;
+// everything else in this package talks to the CSI RPCs over the
+// plug-in's own gRPC server and so uses csp/moc/csi instead.
+
+// SynthesizeEphemeralVolume performs the equivalent of a CreateVolume
+// followed by a ControllerPublishVolume to this node for the inline volume
+// described by req, naming it after the target path so a repeated
+// NodePublishVolume for the same path is idempotent.
+func (s *sp) SynthesizeEphemeralVolume(
+	ctx context.Context, req *rootcsi.NodePublishVolumeRequest) (*rootcsi.VolumeID, error) {
+
+	name := fmt.Sprintf("ephemeral-%s", req.GetTargetPath())
+	v, err := store.Create(name, gib100, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.Attach(v.GetId().GetValues()["id"], nodeIDID); err != nil {
+		return nil, err
+	}
+	return &rootcsi.VolumeID{Values: v.GetId().GetValues()}, nil
+}
+
+// TeardownEphemeralVolume reverses SynthesizeEphemeralVolume.
+func (s *sp) TeardownEphemeralVolume(ctx context.Context, id *rootcsi.VolumeID) error {
+	idv, ok := id.GetValues()["id"]
+	if !ok {
+		return nil
+	}
+	return store.Delete(idv)
+}
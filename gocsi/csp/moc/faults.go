@@ -0,0 +1,222 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EnvVarFaults configures the mock's fault-injection rules, consulted
+// at startup and again on every SIGHUP, so a CO-side retry/idempotency
+// test can be exercised against the mock the same way it would be
+// against a real, occasionally-unreliable driver.
+//
+// The value is a comma-separated list of rules, each scoped to the
+// short RPC method name (e.g. "CreateVolume"):
+//
+//	<Method>:<probability>:<grpc code name>  - fail with that code, that often
+//	<Method>:latency=<duration>              - add latency before dispatch
+//	<Method>:dropfirst=<n>                   - fail the first n calls, then succeed
+//
+// Example:
+//
+//	MOCK_FAULTS=CreateVolume:0.2:Unavailable,ControllerPublishVolume:0.1:DeadlineExceeded,NodePublishVolume:latency=500ms,DeleteVolume:dropfirst=2
+const EnvVarFaults = "MOCK_FAULTS"
+
+// codeNames maps the grpc status code names accepted in EnvVarFaults to
+// their codes.Code, since the grpc codes package exposes no name->code
+// lookup of its own.
+var codeNames = map[string]codes.Code{
+	"OK":                 codes.OK,
+	"Canceled":           codes.Canceled,
+	"Unknown":            codes.Unknown,
+	"InvalidArgument":    codes.InvalidArgument,
+	"DeadlineExceeded":   codes.DeadlineExceeded,
+	"NotFound":           codes.NotFound,
+	"AlreadyExists":      codes.AlreadyExists,
+	"PermissionDenied":   codes.PermissionDenied,
+	"ResourceExhausted":  codes.ResourceExhausted,
+	"FailedPrecondition": codes.FailedPrecondition,
+	"Aborted":            codes.Aborted,
+	"OutOfRange":         codes.OutOfRange,
+	"Unimplemented":      codes.Unimplemented,
+	"Internal":           codes.Internal,
+	"Unavailable":        codes.Unavailable,
+	"DataLoss":           codes.DataLoss,
+	"Unauthenticated":    codes.Unauthenticated,
+}
+
+// faultSpec is the combined set of faults EnvVarFaults configured for a
+// single RPC method. Its fields are independent and all apply: a call
+// can be delayed by latency, then, once dropFirst calls have already
+// been failed, still fail with probability/code.
+type faultSpec struct {
+	latency     time.Duration
+	dropFirst   int
+	probability float64
+	code        codes.Code
+}
+
+// faultInjector is the state behind the fault-injection interceptor:
+// the parsed rules plus, per method, how many calls have been failed
+// so far to satisfy a dropfirst rule.
+type faultInjector struct {
+	mu      sync.RWMutex
+	specs   map[string]*faultSpec
+	dropped map[string]int
+
+	reloadOnce sync.Once
+}
+
+func newFaultInjector() *faultInjector {
+	fi := &faultInjector{}
+	fi.reload()
+	return fi
+}
+
+// reload re-reads EnvVarFaults, replacing the rule set and resetting
+// every dropfirst counter.
+func (fi *faultInjector) reload() {
+	specs := parseFaultRules(os.Getenv(EnvVarFaults))
+	fi.mu.Lock()
+	fi.specs = specs
+	fi.dropped = map[string]int{}
+	fi.mu.Unlock()
+}
+
+// watchReloadSignal starts (once) a goroutine that calls reload every
+// time this process receives SIGHUP, so rules can change without a
+// restart.
+func (fi *faultInjector) watchReloadSignal() {
+	fi.reloadOnce.Do(func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGHUP)
+		go func() {
+			for range sigc {
+				fi.reload()
+				log.Printf("mock: reloaded %s\n", EnvVarFaults)
+			}
+		}()
+	})
+}
+
+// unaryServerInterceptor returns a grpc.UnaryServerInterceptor that
+// applies fi's rules, keyed by the RPC's short method name, ahead of
+// the real handler.
+func (fi *faultInjector) unaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+
+		method := shortMethodName(info.FullMethod)
+
+		fi.mu.RLock()
+		spec, ok := fi.specs[method]
+		fi.mu.RUnlock()
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		if spec.latency > 0 {
+			time.Sleep(spec.latency)
+		}
+
+		if spec.dropFirst > 0 {
+			fi.mu.Lock()
+			n := fi.dropped[method]
+			inject := n < spec.dropFirst
+			if inject {
+				fi.dropped[method] = n + 1
+			}
+			fi.mu.Unlock()
+			if inject {
+				return nil, status.Errorf(codes.Unavailable,
+					"mock: injected failure %d/%d for %s, retry", n+1, spec.dropFirst, method)
+			}
+		}
+
+		if spec.probability > 0 && rand.Float64() < spec.probability {
+			return nil, status.Errorf(spec.code, "mock: injected %s fault for %s", spec.code, method)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// shortMethodName extracts the RPC name from a gRPC FullMethod string
+// such as "/csi.Controller/CreateVolume", returning "CreateVolume".
+func shortMethodName(fullMethod string) string {
+	i := strings.LastIndex(fullMethod, "/")
+	if i < 0 {
+		return fullMethod
+	}
+	return fullMethod[i+1:]
+}
+
+// parseFaultRules parses EnvVarFaults' comma-separated rule list into a
+// faultSpec per method, ignoring any rule it can't parse so a typo in
+// one rule doesn't take down the whole list.
+func parseFaultRules(raw string) map[string]*faultSpec {
+	specs := map[string]*faultSpec{}
+	if raw == "" {
+		return specs
+	}
+
+	for _, rule := range strings.Split(raw, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		parts := strings.Split(rule, ":")
+		if len(parts) < 2 {
+			continue
+		}
+
+		method := parts[0]
+		spec := specs[method]
+		if spec == nil {
+			spec = &faultSpec{}
+			specs[method] = spec
+		}
+
+		rest := parts[1:]
+		if len(rest) == 1 && strings.Contains(rest[0], "=") {
+			kv := strings.SplitN(rest[0], "=", 2)
+			switch kv[0] {
+			case "latency":
+				if d, err := time.ParseDuration(kv[1]); err == nil {
+					spec.latency = d
+				}
+			case "dropfirst":
+				if n, err := strconv.Atoi(kv[1]); err == nil {
+					spec.dropFirst = n
+				}
+			}
+			continue
+		}
+
+		if len(rest) >= 2 {
+			if p, err := strconv.ParseFloat(rest[0], 64); err == nil {
+				spec.probability = p
+			}
+			if c, ok := codeNames[rest[1]]; ok {
+				spec.code = c
+			} else {
+				spec.code = codes.Unavailable
+			}
+		}
+	}
+
+	return specs
+}
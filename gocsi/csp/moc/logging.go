@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EnvVarLogLevel sets the verbosity of the mock's request logging,
+// consulted once at package initialization. It mirrors klog's V(n)
+// convention: 1 (the default) logs only a method/duration/status-code
+// line per RPC, while 4 also logs the sanitized request and response,
+// replacing what used to be ad-hoc log.Printf calls sprinkled through
+// the handlers.
+const EnvVarLogLevel = "X_CSI_MOCK_LOG_LEVEL"
+
+// Level is a logging verbosity, checked against EnvVarLogLevel the same
+// way klog.V gates an Infof call.
+type Level int32
+
+var logLevel = levelFromEnv()
+
+func levelFromEnv() Level {
+	s := os.Getenv(EnvVarLogLevel)
+	if s == "" {
+		return 1
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 1
+	}
+	return Level(i)
+}
+
+// Verbose wraps a Level check so callers can write V(4).Infof(...)
+// instead of guarding every verbose log.Printf by hand.
+type Verbose bool
+
+// V reports whether logging at level is enabled.
+func V(level Level) Verbose {
+	return Verbose(level <= logLevel)
+}
+
+// Infof logs format/args if the Verbose it's called on is true.
+func (v Verbose) Infof(format string, args ...interface{}) {
+	if v {
+		log.Printf(format, args...)
+	}
+}
+
+// redactedFieldNames lists the struct field names unaryServerLogging
+// strips from a request/response before logging it, in the spirit of
+// csi-lib-utils/protosanitizer's secret stripping.
+var redactedFieldNames = []string{"UserCredentials", "Secrets"}
+
+// redact returns a shallow copy of msg with any field named in
+// redactedFieldNames replaced by "***", so logging a request/response
+// can never leak a credential verbatim.
+func redact(msg interface{}) interface{} {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return msg
+	}
+
+	cp := reflect.New(v.Elem().Type())
+	cp.Elem().Set(v.Elem())
+
+	for _, name := range redactedFieldNames {
+		f := cp.Elem().FieldByName(name)
+		if !f.IsValid() || !f.CanSet() || f.Kind() != reflect.Map {
+			continue
+		}
+		redacted := reflect.MakeMap(f.Type())
+		for _, k := range f.MapKeys() {
+			redacted.SetMapIndex(k, reflect.ValueOf("***").Convert(f.Type().Elem()))
+		}
+		f.Set(redacted)
+	}
+
+	return cp.Interface()
+}
+
+// unaryServerLogging returns a grpc.UnaryServerInterceptor that logs
+// every unary RPC's method, duration, and resulting status code at
+// V(1), and its sanitized request/response at V(4).
+func unaryServerLogging() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+
+		start := time.Now()
+		resp, err := handler(ctx, req)
+
+		V(1).Infof("%s took %s code=%s\n",
+			info.FullMethod, time.Since(start), status.Code(err))
+		V(4).Infof("%s request=%+v response=%+v\n",
+			info.FullMethod, redact(req), redact(resp))
+
+		return resp, err
+	}
+}
+
+// unaryServerRecovery returns a grpc.UnaryServerInterceptor that
+// recovers a panicking handler, logs the panic value and a stack trace,
+// and turns it into a codes.Internal error rather than crashing the
+// process and taking down every other in-flight RPC with it.
+func unaryServerRecovery() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (resp interface{}, err error) {
+
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("panic handling %s: %v\n%s", info.FullMethod, r, debug.Stack())
+				err = status.Error(codes.Internal, fmt.Sprintf("panic: %v", r))
+			}
+		}()
+
+		return handler(ctx, req)
+	}
+}
+
+// chainUnaryInterceptors composes interceptors into a single
+// grpc.UnaryServerInterceptor that invokes them in order, each wrapping
+// the next, with handler as the innermost call.
+func chainUnaryInterceptors(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			ic, cur := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return ic(ctx, req, info, cur)
+			}
+		}
+		return next(ctx, req)
+	}
+}
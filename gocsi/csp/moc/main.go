@@ -10,13 +10,13 @@ import (
 	"net"
 	"os"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/container-storage-interface/examples/gocsi/csp/moc/csi"
 )
@@ -79,7 +79,14 @@ func (s *sp) Serve(ctx context.Context, li net.Listener) error {
 		if s.server != nil {
 			return errServerStarted
 		}
-		s.server = grpc.NewServer()
+		faults.watchReloadSignal()
+		s.server = grpc.NewServer(grpc.UnaryInterceptor(chainUnaryInterceptors(
+			[]grpc.UnaryServerInterceptor{
+				unaryServerRecovery(),
+				unaryServerLogging(),
+				faults.unaryServerInterceptor(),
+			},
+		)))
 		return nil
 	}(); err != nil {
 		return errServerStarted
@@ -132,22 +139,6 @@ func (s *sp) CreateVolume(
 	req *csi.CreateVolumeRequest) (
 	*csi.CreateVolumeResponse, error) {
 
-	log.Printf(
-		"mock.CreateVolums.Version=%s\n",
-		SprintfVersion(req.GetVersion()))
-	log.Printf(
-		"mock.CreateVolums.CapacityRange=%+v\n",
-		req.GetCapacityRange())
-	log.Printf(
-		"mock.CreateVolums.Name=%v\n",
-		req.GetName())
-	log.Printf(
-		"mock.CreateVolums.Parameters=%+v\n",
-		req.GetParameters())
-	log.Printf(
-		"mock.CreateVolums.VolumeCapabilities=%+v\n",
-		req.GetVolumeCapabilities())
-
 	// assert that the name is not empty
 	name := req.GetName()
 	if name == "" {
@@ -155,25 +146,26 @@ func (s *sp) CreateVolume(
 		return ErrCreateVolume(3, "missing name"), nil
 	}
 
-	s.Lock()
-	defer s.Unlock()
+	if !volLocks.TryAcquire(name) {
+		// OPERATION_PENDING_FOR_VOLUME
+		return ErrCreateVolumeGeneral(4, "operation pending for volume"), nil
+	}
+	defer volLocks.Release(name)
 
-	// the creation process is idempotent: if the volume
-	// does not already exist then create it, otherwise
-	// just return the existing volume
-	_, v := findVolByName(name)
-	if v == nil {
-		capacity := gib100
-		if cr := req.GetCapacityRange(); cr != nil {
-			if rb := cr.GetRequiredBytes(); rb != 0 {
-				capacity = rb
-			}
+	capacity := gib100
+	if cr := req.GetCapacityRange(); cr != nil {
+		if rb := cr.GetRequiredBytes(); rb != 0 {
+			capacity = rb
 		}
-		v = newVolume(name, capacity)
-		vols = append(vols, v)
 	}
 
-	log.Printf("...Volums.ID=%s\n", v.Id.Values["id"])
+	// Create is idempotent: if the volume already exists it's returned
+	// as-is, otherwise it's created with capacity and topology.
+	topology := chooseTopology(req.GetAccessibilityRequirements())
+	v, err := store.Create(name, capacity, topology)
+	if err != nil {
+		return ErrCreateVolumeGeneral(0, err.Error()), nil
+	}
 
 	return &csi.CreateVolumeResponse{
 		Reply: &csi.CreateVolumeResponse_Result_{
@@ -207,17 +199,14 @@ func (s *sp) DeleteVolume(
 		return ErrDeleteVolume(3, "missing id val"), nil
 	}
 
-	s.Lock()
-	defer s.Unlock()
+	if !volLocks.TryAcquire(id) {
+		// OPERATION_PENDING_FOR_VOLUME
+		return ErrDeleteVolumeGeneral(4, "operation pending for volume"), nil
+	}
+	defer volLocks.Release(id)
 
-	x, v := findVol("id", id)
-	if v != nil {
-		// this delete logic won't preserve order,
-		// but it will prevent any potential mem
-		// leaks due to orphaned references
-		vols[x] = vols[len(vols)-1]
-		vols[len(vols)-1] = nil
-		vols = vols[:len(vols)-1]
+	if err := store.Delete(id); err != nil {
+		return ErrDeleteVolumeGeneral(0, err.Error()), nil
 	}
 
 	return nil, nil
@@ -228,22 +217,6 @@ func (s *sp) ControllerPublishVolume(
 	req *csi.ControllerPublishVolumeRequest) (
 	*csi.ControllerPublishVolumeResponse, error) {
 
-	log.Printf(
-		"mock.ControllerPublishVolums.Version=%s\n",
-		SprintfVersion(req.GetVersion()))
-	log.Printf(
-		"mock.ControllerPublishVolums.VolumeID=%+v\n",
-		req.GetVolumeId())
-	log.Printf(
-		"mock.ControllerPublishVolums.VolumeMetadata=%v\n",
-		req.GetVolumeMetadata())
-	log.Printf(
-		"mock.ControllerPublishVolums.NodeID=%+v\n",
-		req.GetNodeId())
-	log.Printf(
-		"mock.ControllerPublishVolums.ReadOnly=%+v\n",
-		req.GetReadonly())
-
 	idObj := req.GetVolumeId()
 	if idObj == nil {
 		// INVALID_VOLUME_ID
@@ -280,30 +253,32 @@ func (s *sp) ControllerPublishVolume(
 		return ErrControllerPublishVolume(7, "node id required"), nil
 	}
 
-	// the key used with the volume's metadata to see if the volume
-	// is attached to a given node id
-	attk := fmt.Sprintf("devpath.%s", nidid)
-
-	s.Lock()
-	defer s.Unlock()
+	if !volLocks.TryAcquire(id) {
+		// OPERATION_PENDING_FOR_VOLUME
+		return ErrControllerPublishVolumeGeneral(4, "operation pending for volume"), nil
+	}
+	defer volLocks.Release(id)
 
-	_, v := findVol("id", id)
+	v, err := store.FindByID(id)
+	if err != nil {
+		return ErrControllerPublishVolumeGeneral(0, err.Error()), nil
+	}
 	if v == nil {
 		// VOLUME_DOES_NOT_EXIST
 		return ErrControllerPublishVolume(5, "missing volume"), nil
 	}
+	if !nodeAccessibleTo(nidid, v.AccessibleTopology) {
+		// VOLUME_NOT_ACCESSIBLE_FROM_NODE
+		return ErrControllerPublishVolume(9, "volume not accessible from node"), nil
+	}
 
-	// a "new" device path
-	var devpath string
-
-	// check to see if the volume is attached to this nods. if it
-	// is then return the existing dev path
-	if p, ok := v.Metadata.Values[attk]; ok {
-		devpath = p
-	} else {
-		// attach the volume
-		devpath = fmt.Sprintf("%d", time.Now().UTC().Unix())
-		v.Metadata.Values[attk] = devpath
+	devpath, err := store.Attach(id, nidid)
+	if err == errVolumeNotFound {
+		// VOLUME_DOES_NOT_EXIST
+		return ErrControllerPublishVolume(5, "missing volume"), nil
+	}
+	if err != nil {
+		return ErrControllerPublishVolumeGeneral(0, err.Error()), nil
 	}
 
 	resp := &csi.ControllerPublishVolumeResponse{
@@ -318,7 +293,6 @@ func (s *sp) ControllerPublishVolume(
 		},
 	}
 
-	log.Printf("mock.ControllerPublishVolums.Response=%+v\n", resp)
 	return resp, nil
 }
 
@@ -363,28 +337,24 @@ func (s *sp) ControllerUnpublishVolume(
 		return ErrControllerUnpublishVolume(9, "node id required"), nil
 	}
 
-	// the key used with the volume's metadata to see if the volume
-	// is attached to a given node id
-	attk := fmt.Sprintf("devpath.%s", nidid)
-
-	s.Lock()
-	defer s.Unlock()
+	if !volLocks.TryAcquire(id) {
+		// OPERATION_PENDING_FOR_VOLUME
+		return ErrControllerUnpublishVolumeGeneral(4, "operation pending for volume"), nil
+	}
+	defer volLocks.Release(id)
 
-	_, v := findVol("id", id)
-	if v == nil {
+	switch err := store.Detach(id, nidid); err {
+	case nil:
+	case errVolumeNotFound:
 		// VOLUME_DOES_NOT_EXIST
 		return ErrControllerUnpublishVolume(5, "missing volume"), nil
-	}
-
-	// check to see if the volume is attached to thi node
-	if _, ok := v.Metadata.Values[attk]; !ok {
+	case errVolumeNotAttached:
 		// VOLUME_NOT_ATTACHED_TO_SPECIFIED_NODE
 		return ErrControllerUnpublishVolume(8, "not attached"), nil
+	default:
+		return ErrControllerUnpublishVolumeGeneral(0, err.Error()), nil
 	}
 
-	// zero out the device path for this node
-	delete(v.Metadata.Values, attk)
-
 	return &csi.ControllerUnpublishVolumeResponse{
 		Reply: &csi.ControllerUnpublishVolumeResponse_Result_{
 			Result: &csi.ControllerUnpublishVolumeResponse_Result{},
@@ -405,11 +375,13 @@ func (s *sp) ListVolumes(
 	req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse, error) {
 
-	s.Lock()
-	defer s.Unlock()
+	storeLen, err := store.Len()
+	if err != nil {
+		return ErrListVolumes(0, err.Error()), nil
+	}
 
 	var (
-		ulenVols      = uint32(len(vols))
+		ulenVols      = uint32(storeLen)
 		maxEntries    = uint32(req.GetMaxEntries())
 		startingToken uint32
 	)
@@ -430,23 +402,20 @@ func (s *sp) ListVolumes(
 			startingToken, ulenVols)), nil
 	}
 
+	vols, nextIndex, err := store.List(startingToken, maxEntries)
+	if err != nil {
+		return ErrListVolumes(0, err.Error()), nil
+	}
+
 	entries := []*csi.ListVolumesResponse_Result_Entry{}
-	lena := uint32(0)
-	for x := startingToken; x < ulenVols; x++ {
-		if maxEntries > 0 && lena >= maxEntries {
-			break
-		}
-		v := vols[x]
-		log.Printf("...Volums.ID=%s\n", v.Id.Values["id"])
+	for _, v := range vols {
 		entries = append(entries,
 			&csi.ListVolumesResponse_Result_Entry{VolumeInfo: v})
-		lena++
 	}
 
 	var nextToken string
-	if (startingToken + lena) < ulenVols {
-		nextToken = fmt.Sprintf("%d", startingToken+lena)
-		fmt.Printf("nextToken=%s\n", nextToken)
+	if nextIndex < ulenVols {
+		nextToken = fmt.Sprintf("%d", nextIndex)
 	}
 
 	return &csi.ListVolumesResponse{
@@ -514,12 +483,68 @@ func (s *sp) ControllerGetCapabilities(
 							},
 						},
 					},
+					&csi.ControllerServiceCapability{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								// EXPAND_VOLUME
+								Type: 6,
+							},
+						},
+					},
 				},
 			},
 		},
 	}, nil
 }
 
+func (s *sp) ControllerExpandVolume(
+	ctx context.Context,
+	req *csi.ControllerExpandVolumeRequest) (
+	*csi.ControllerExpandVolumeResponse, error) {
+
+	idObj := req.GetVolumeId()
+	if idObj == nil {
+		// INVALID_VOLUME_ID
+		return ErrControllerExpandVolume(3, "missing id obj"), nil
+	}
+
+	id, ok := idObj.GetValues()["id"]
+	if !ok {
+		// INVALID_VOLUME_ID
+		return ErrControllerExpandVolume(3, "missing id val"), nil
+	}
+
+	if !volLocks.TryAcquire(id) {
+		// OPERATION_PENDING_FOR_VOLUME
+		return ErrControllerExpandVolumeGeneral(4, "operation pending for volume"), nil
+	}
+	defer volLocks.Release(id)
+
+	cr := req.GetCapacityRange()
+	if cr == nil || cr.GetRequiredBytes() == 0 {
+		// INVALID_VOLUME_SIZE
+		return ErrControllerExpandVolume(4, "missing capacity range"), nil
+	}
+
+	v, err := store.Expand(id, cr.GetRequiredBytes())
+	if err == errVolumeNotFound {
+		// VOLUME_DOES_NOT_EXIST
+		return ErrControllerExpandVolume(5, "missing volume"), nil
+	}
+	if err != nil {
+		return ErrControllerExpandVolumeGeneral(0, err.Error()), nil
+	}
+
+	return &csi.ControllerExpandVolumeResponse{
+		Reply: &csi.ControllerExpandVolumeResponse_Result_{
+			Result: &csi.ControllerExpandVolumeResponse_Result{
+				CapacityBytes:         v.CapacityBytes,
+				NodeExpansionRequired: true,
+			},
+		},
+	}, nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 //                             Identity Service                               //
 ////////////////////////////////////////////////////////////////////////////////
@@ -587,14 +612,11 @@ func (s *sp) NodePublishVolume(
 		return ErrNodePublishVolumeGeneral(3, "missing id val"), nil
 	}
 
-	s.Lock()
-	defer s.Unlock()
-
-	_, v := findVol("id", id)
-	if v == nil {
-		// VOLUME_DOES_NOT_EXIST
-		return ErrNodePublishVolume(2, "missing volume"), nil
+	if !volLocks.TryAcquire(id) {
+		// OPERATION_PENDING_FOR_VOLUME
+		return ErrNodePublishVolumeGeneral(4, "operation pending for volume"), nil
 	}
+	defer volLocks.Release(id)
 
 	mntpath := req.GetTargetPath()
 	if mntpath == "" {
@@ -602,8 +624,12 @@ func (s *sp) NodePublishVolume(
 		return ErrNodePublishVolume(3, "missing mount path"), nil
 	}
 
-	// record the mount path
-	v.Metadata.Values[nodeMntpath] = mntpath
+	if err := store.Publish(id, mntpath); err == errVolumeNotFound {
+		// VOLUME_DOES_NOT_EXIST
+		return ErrNodePublishVolume(2, "missing volume"), nil
+	} else if err != nil {
+		return ErrNodePublishVolumeGeneral(0, err.Error()), nil
+	}
 
 	return &csi.NodePublishVolumeResponse{
 		Reply: &csi.NodePublishVolumeResponse_Result_{
@@ -629,24 +655,25 @@ func (s *sp) NodeUnpublishVolume(
 		return ErrNodeUnpublishVolumeGeneral(3, "missing id map"), nil
 	}
 
-	s.Lock()
-	defer s.Unlock()
-
 	id, ok := idVals["id"]
 	if !ok {
 		// VOLUME_DOES_NOT_EXIST
 		return ErrNodeUnpublishVolume(2, "missing id val"), nil
 	}
 
-	_, v := findVol("id", id)
-	if v == nil {
+	if !volLocks.TryAcquire(id) {
+		// OPERATION_PENDING_FOR_VOLUME
+		return ErrNodeUnpublishVolumeGeneral(4, "operation pending for volume"), nil
+	}
+	defer volLocks.Release(id)
+
+	if err := store.Unpublish(id); err == errVolumeNotFound {
 		// VOLUME_DOES_NOT_EXIST
 		return ErrNodeUnpublishVolume(2, "missing volume"), nil
+	} else if err != nil {
+		return ErrNodeUnpublishVolumeGeneral(0, err.Error()), nil
 	}
 
-	// zero out the mount path for this node
-	delete(v.Metadata.Values, nodeMntpath)
-
 	return &csi.NodeUnpublishVolumeResponse{
 		Reply: &csi.NodeUnpublishVolumeResponse_Result_{
 			Result: &csi.NodeUnpublishVolumeResponse_Result{},
@@ -662,7 +689,9 @@ func (s *sp) GetNodeID(
 	return &csi.GetNodeIDResponse{
 		Reply: &csi.GetNodeIDResponse_Result_{
 			Result: &csi.GetNodeIDResponse_Result{
-				NodeId: nodeID,
+				NodeId:             nodeID,
+				AccessibleTopology: nodeTopology,
+				MaxVolumesPerNode:  maxVolumesPerNode,
 			},
 		},
 	}, nil
@@ -705,12 +734,103 @@ func (s *sp) NodeGetCapabilities(
 							},
 						},
 					},
+					&csi.NodeServiceCapability{
+						Type: &csi.NodeServiceCapability_Rpc{
+							Rpc: &csi.NodeServiceCapability_RPC{
+								// GET_VOLUME_STATS
+								Type: 2,
+							},
+						},
+					},
+					&csi.NodeServiceCapability{
+						Type: &csi.NodeServiceCapability_Rpc{
+							Rpc: &csi.NodeServiceCapability_RPC{
+								// EXPAND_VOLUME
+								Type: 3,
+							},
+						},
+					},
 				},
 			},
 		},
 	}, nil
 }
 
+func (s *sp) NodeGetVolumeStats(
+	ctx context.Context,
+	req *csi.NodeGetVolumeStatsRequest) (
+	*csi.NodeGetVolumeStatsResponse, error) {
+
+	id := req.GetVolumeId()
+	path := req.GetVolumePath()
+	if id == "" || path == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume_id and volume_path are required")
+	}
+
+	v, err := store.FindByID(id)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if v == nil {
+		return nil, status.Error(codes.NotFound, "volume does not exist")
+	}
+	if v.Metadata.Values[nodeMntpath] != path {
+		return nil, status.Error(codes.NotFound, "volume is not published at volume_path")
+	}
+
+	totalBytes := int64(v.CapacityBytes)
+	usedBytes := totalBytes / 4
+
+	totalInodes := totalBytes / int64(4*kib)
+	usedInodes := totalInodes / 4
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     totalBytes,
+				Used:      usedBytes,
+				Available: totalBytes - usedBytes,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     totalInodes,
+				Used:      usedInodes,
+				Available: totalInodes - usedInodes,
+			},
+		},
+	}, nil
+}
+
+func (s *sp) NodeExpandVolume(
+	ctx context.Context,
+	req *csi.NodeExpandVolumeRequest) (
+	*csi.NodeExpandVolumeResponse, error) {
+
+	id, ok := req.GetVolumeId().GetValues()["id"]
+	if !ok {
+		// MISSING_REQUIRED_FIELD
+		return ErrNodeExpandVolumeGeneral(3, "missing id val"), nil
+	}
+
+	v, err := store.FindByID(id)
+	if err != nil {
+		return ErrNodeExpandVolumeGeneral(0, err.Error()), nil
+	}
+	if v == nil {
+		// VOLUME_DOES_NOT_EXIST
+		return ErrNodeExpandVolumeGeneral(2, "missing volume"), nil
+	}
+
+	return &csi.NodeExpandVolumeResponse{
+		Reply: &csi.NodeExpandVolumeResponse_Result_{
+			Result: &csi.NodeExpandVolumeResponse_Result{
+				CapacityBytes: v.CapacityBytes,
+			},
+		},
+	}, nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 //                                  Utils                                     //
 ////////////////////////////////////////////////////////////////////////////////
@@ -731,11 +851,11 @@ const (
 var (
 	nextVolID uint64
 
-	vols = []*csi.VolumeInfo{
-		newVolume("Mock Volume 1", gib100),
-		newVolume("Mock Volume 2", gib100),
-		newVolume("Mock Volume 3", gib100),
-	}
+	store = mustNewVolumeStore()
+
+	volLocks = newVolumeLocks()
+
+	faults = newFaultInjector()
 
 	nodeID = &csi.NodeID{
 		Values: map[string]string{
@@ -746,7 +866,15 @@ var (
 	version = &csi.Version{Major: 0, Minor: 1, Patch: 0}
 )
 
-func newVolume(name string, capcity uint64) *csi.VolumeInfo {
+func mustNewVolumeStore() VolumeStore {
+	s, err := newVolumeStoreFromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("gocsi: mock: %v", err))
+	}
+	return s
+}
+
+func newVolume(name string, capcity uint64, topology []*csi.Topology) *csi.VolumeInfo {
 	id := atomic.AddUint64(&nextVolID, 1)
 	vi := &csi.VolumeInfo{
 		Id: &csi.VolumeID{
@@ -758,44 +886,41 @@ func newVolume(name string, capcity uint64) *csi.VolumeInfo {
 		Metadata: &csi.VolumeMetadata{
 			Values: map[string]string{},
 		},
-		CapacityBytes: capcity,
+		CapacityBytes:      capcity,
+		AccessibleTopology: topology,
 	}
 	return vi
 }
 
-func findVolByID(id *csi.VolumeID) (int, *csi.VolumeInfo) {
-	if id == nil || len(id.Values) == 0 {
-		return -1, nil
-	}
-	if idv, ok := id.Values["id"]; ok {
-		return findVol("id", idv)
-	}
-	if idv, ok := id.Values["name"]; ok {
-		return findVol("name", idv)
-	}
-	return -1, nil
+// VolumeLocks tracks volume identifiers with an operation in flight, so
+// concurrent RPCs for the same id/name fail fast with
+// OPERATION_PENDING_FOR_VOLUME instead of queuing behind a global lock,
+// the pattern ceph-csi's VolumeLocks established for exactly this
+// problem.
+type VolumeLocks struct {
+	mu  sync.Mutex
+	ids map[string]struct{}
 }
 
-func findVolByName(name string) (int, *csi.VolumeInfo) {
-	return findVol("name", name)
+func newVolumeLocks() *VolumeLocks {
+	return &VolumeLocks{ids: map[string]struct{}{}}
 }
 
-func findVol(field, val string) (int, *csi.VolumeInfo) {
-	for x, v := range vols {
-		id := v.Id
-		if id == nil {
-			continue
-		}
-		if len(id.Values) == 0 {
-			continue
-		}
-		fv, ok := id.Values[field]
-		if !ok {
-			continue
-		}
-		if strings.EqualFold(fv, val) {
-			return x, v
-		}
+// TryAcquire reports whether id has no operation in flight and, if so,
+// marks it as locked.
+func (l *VolumeLocks) TryAcquire(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.ids[id]; ok {
+		return false
 	}
-	return -1, nil
+	l.ids[id] = struct{}{}
+	return true
+}
+
+// Release clears id's in-flight operation.
+func (l *VolumeLocks) Release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.ids, id)
 }
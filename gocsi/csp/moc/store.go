@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/examples/gocsi/csp/moc/csi"
+)
+
+const (
+	// EnvVarStoreType selects the VolumeStore implementation the mock
+	// keeps its volumes in: "memory" (the default) or "file".
+	EnvVarStoreType = "X_CSI_MOCK_STORE_TYPE"
+
+	// EnvVarStoreFile is the path a "file" store reads its volumes from
+	// and persists them to. Defaults to defaultStoreFile.
+	EnvVarStoreFile = "X_CSI_MOCK_STORE_FILE"
+
+	defaultStoreFile = "mock-volumes.json"
+)
+
+var (
+	errVolumeNotFound    = errors.New("gocsi: mock: volume does not exist")
+	errVolumeNotAttached = errors.New("gocsi: mock: volume not attached to node")
+)
+
+// VolumeStore is the persistence boundary between the mock's RPC
+// handlers and wherever volume state actually lives, so swapping the
+// in-memory store for one that survives a restart - or, for a real
+// plug-in, one backed by whatever the plug-in's storage system is - is a
+// matter of implementing this interface rather than reaching into RPC
+// handlers. newVolumeStoreFromEnv selects an implementation the same way
+// hostpath, ceph-csi and vitastor let a config path point at their
+// backing store.
+type VolumeStore interface {
+	// Create returns the volume named name, creating it with
+	// capacityBytes and topology if it doesn't already exist.
+	// CreateVolume is idempotent, so callers don't need to check
+	// FindByName first.
+	Create(name string, capacityBytes uint64, topology []*csi.Topology) (*csi.VolumeInfo, error)
+
+	// Delete removes the volume with the given id, if any.
+	Delete(id string) error
+
+	// FindByID returns the volume with the given id, or nil if none
+	// exists.
+	FindByID(id string) (*csi.VolumeInfo, error)
+
+	// FindByName returns the volume with the given name, or nil if none
+	// exists.
+	FindByName(name string) (*csi.VolumeInfo, error)
+
+	// List returns up to maxEntries volumes (no limit if maxEntries is
+	// 0) starting at startingToken, along with the token the next page
+	// should start at.
+	List(startingToken, maxEntries uint32) (entries []*csi.VolumeInfo, nextToken uint32, err error)
+
+	// Len reports how many volumes are currently stored.
+	Len() (int, error)
+
+	// Expand updates volume id's capacity, returning the updated
+	// volume.
+	Expand(id string, capacityBytes uint64) (*csi.VolumeInfo, error)
+
+	// Attach records that volume id is attached to nodeID, returning its
+	// device path. Calling it again for a volume already attached to
+	// nodeID is a no-op that returns the existing path, since
+	// ControllerPublishVolume is idempotent.
+	Attach(id, nodeID string) (devPath string, err error)
+
+	// Detach reverses Attach. It returns errVolumeNotAttached if id
+	// isn't currently attached to nodeID.
+	Detach(id, nodeID string) error
+
+	// Publish records that volume id is node-published at targetPath.
+	Publish(id, targetPath string) error
+
+	// Unpublish reverses Publish.
+	Unpublish(id string) error
+}
+
+// newVolumeStoreFromEnv selects and constructs a VolumeStore based on
+// EnvVarStoreType, consulted once at package initialization. The
+// "memory" store (the default) seeds three canned volumes and forgets
+// them on exit; the "file" store loads whatever EnvVarStoreFile already
+// holds and fsyncs it on every mutation, so a restarted mock keeps its
+// volumes.
+func newVolumeStoreFromEnv() (VolumeStore, error) {
+	switch os.Getenv(EnvVarStoreType) {
+	case "file":
+		path := os.Getenv(EnvVarStoreFile)
+		if path == "" {
+			path = defaultStoreFile
+		}
+		return newFileVolumeStore(path)
+	default:
+		return newMemVolumeStore(
+			newVolume("Mock Volume 1", gib100, nil),
+			newVolume("Mock Volume 2", gib100, nil),
+			newVolume("Mock Volume 3", gib100, nil),
+		), nil
+	}
+}
+
+// attachKey is the metadata key used to record whether a volume is
+// attached to a given node id.
+func attachKey(nodeID string) string { return fmt.Sprintf("devpath.%s", nodeID) }
+
+// memVolumeStore guards the mock's volumes behind a sync.RWMutex scoped
+// to just the id/name indexes, instead of the sp-wide mutex that used to
+// serialize every RPC - including unrelated reads like ListVolumes -
+// behind whichever write was in flight. order preserves creation order
+// so ListVolumes' numeric startingToken pagination behaves exactly as it
+// did over the old slice, while byID/byName replace the O(n) findVol
+// scans with map lookups.
+type memVolumeStore struct {
+	mu     sync.RWMutex
+	byID   map[string]*csi.VolumeInfo
+	byName map[string]*csi.VolumeInfo
+	order  []string
+}
+
+func newMemVolumeStore(initial ...*csi.VolumeInfo) *memVolumeStore {
+	s := &memVolumeStore{byID: map[string]*csi.VolumeInfo{}, byName: map[string]*csi.VolumeInfo{}}
+	for _, v := range initial {
+		s.insert(v)
+	}
+	return s
+}
+
+// insert adds v to the store. Callers must hold s.mu.
+func (s *memVolumeStore) insert(v *csi.VolumeInfo) {
+	id := v.Id.Values["id"]
+	s.byID[id] = v
+	if name, ok := v.Id.Values["name"]; ok {
+		s.byName[name] = v
+	}
+	s.order = append(s.order, id)
+}
+
+func (s *memVolumeStore) Create(name string, capacityBytes uint64, topology []*csi.Topology) (*csi.VolumeInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.byName[name]; ok {
+		return v, nil
+	}
+	v := newVolume(name, capacityBytes, topology)
+	s.insert(v)
+	return v, nil
+}
+
+func (s *memVolumeStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.byID[id]
+	if !ok {
+		return nil
+	}
+	delete(s.byID, id)
+	if name, ok := v.Id.Values["name"]; ok {
+		delete(s.byName, name)
+	}
+	for i, vid := range s.order {
+		if vid == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memVolumeStore) FindByID(id string) (*csi.VolumeInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byID[id], nil
+}
+
+func (s *memVolumeStore) FindByName(name string) (*csi.VolumeInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byName[name], nil
+}
+
+func (s *memVolumeStore) Len() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.order), nil
+}
+
+func (s *memVolumeStore) List(startingToken, maxEntries uint32) ([]*csi.VolumeInfo, uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var entries []*csi.VolumeInfo
+	for i := startingToken; i < uint32(len(s.order)); i++ {
+		if maxEntries > 0 && uint32(len(entries)) >= maxEntries {
+			break
+		}
+		entries = append(entries, s.byID[s.order[i]])
+	}
+	return entries, startingToken + uint32(len(entries)), nil
+}
+
+func (s *memVolumeStore) Expand(id string, capacityBytes uint64) (*csi.VolumeInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.byID[id]
+	if !ok {
+		return nil, errVolumeNotFound
+	}
+	v.CapacityBytes = capacityBytes
+	return v, nil
+}
+
+func (s *memVolumeStore) Attach(id, nodeID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.byID[id]
+	if !ok {
+		return "", errVolumeNotFound
+	}
+	attk := attachKey(nodeID)
+	if p, ok := v.Metadata.Values[attk]; ok {
+		return p, nil
+	}
+	devPath := fmt.Sprintf("%d", time.Now().UTC().Unix())
+	v.Metadata.Values[attk] = devPath
+	return devPath, nil
+}
+
+func (s *memVolumeStore) Detach(id, nodeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.byID[id]
+	if !ok {
+		return errVolumeNotFound
+	}
+	attk := attachKey(nodeID)
+	if _, ok := v.Metadata.Values[attk]; !ok {
+		return errVolumeNotAttached
+	}
+	delete(v.Metadata.Values, attk)
+	return nil
+}
+
+func (s *memVolumeStore) Publish(id, targetPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.byID[id]
+	if !ok {
+		return errVolumeNotFound
+	}
+	v.Metadata.Values[nodeMntpath] = targetPath
+	return nil
+}
+
+func (s *memVolumeStore) Unpublish(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.byID[id]
+	if !ok {
+		return errVolumeNotFound
+	}
+	delete(v.Metadata.Values, nodeMntpath)
+	return nil
+}
+
+// fileVolumeStore wraps a memVolumeStore, loading it from path on
+// construction and re-writing path in full - fsynced - after every
+// mutation, so a restarted mock picks up right where it left off instead
+// of coming back up with three canned volumes again.
+type fileVolumeStore struct {
+	mem  *memVolumeStore
+	path string
+}
+
+func newFileVolumeStore(path string) (*fileVolumeStore, error) {
+	s := &fileVolumeStore{mem: newMemVolumeStore(), path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileVolumeStore) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("gocsi: mock: read volume store %s: %v", s.path, err)
+	}
+	var vols []*csi.VolumeInfo
+	if err := json.Unmarshal(data, &vols); err != nil {
+		return fmt.Errorf("gocsi: mock: parse volume store %s: %v", s.path, err)
+	}
+	for _, v := range vols {
+		s.mem.insert(v)
+		// advance nextVolID past every loaded id so newVolume never
+		// reissues one
+		if n, err := strconv.ParseUint(v.Id.Values["id"], 10, 64); err == nil && n > nextVolID {
+			nextVolID = n
+		}
+	}
+	return nil
+}
+
+// persist rewrites the entire volume set to s.path and fsyncs it, so a
+// crash right after a mutation can't leave the file half-written.
+func (s *fileVolumeStore) persist() error {
+	vols, _, err := s.mem.List(0, 0)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(vols, "", "  ")
+	if err != nil {
+		return fmt.Errorf("gocsi: mock: marshal volume store: %v", err)
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("gocsi: mock: open volume store %s: %v", s.path, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("gocsi: mock: write volume store %s: %v", s.path, err)
+	}
+	return f.Sync()
+}
+
+func (s *fileVolumeStore) Create(name string, capacityBytes uint64, topology []*csi.Topology) (*csi.VolumeInfo, error) {
+	v, err := s.mem.Create(name, capacityBytes, topology)
+	if err != nil {
+		return nil, err
+	}
+	return v, s.persist()
+}
+
+func (s *fileVolumeStore) Delete(id string) error {
+	if err := s.mem.Delete(id); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+func (s *fileVolumeStore) FindByID(id string) (*csi.VolumeInfo, error) {
+	return s.mem.FindByID(id)
+}
+
+func (s *fileVolumeStore) FindByName(name string) (*csi.VolumeInfo, error) {
+	return s.mem.FindByName(name)
+}
+
+func (s *fileVolumeStore) List(startingToken, maxEntries uint32) ([]*csi.VolumeInfo, uint32, error) {
+	return s.mem.List(startingToken, maxEntries)
+}
+
+func (s *fileVolumeStore) Len() (int, error) {
+	return s.mem.Len()
+}
+
+func (s *fileVolumeStore) Expand(id string, capacityBytes uint64) (*csi.VolumeInfo, error) {
+	v, err := s.mem.Expand(id, capacityBytes)
+	if err != nil {
+		return nil, err
+	}
+	return v, s.persist()
+}
+
+func (s *fileVolumeStore) Attach(id, nodeID string) (string, error) {
+	devPath, err := s.mem.Attach(id, nodeID)
+	if err != nil {
+		return "", err
+	}
+	return devPath, s.persist()
+}
+
+func (s *fileVolumeStore) Detach(id, nodeID string) error {
+	if err := s.mem.Detach(id, nodeID); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+func (s *fileVolumeStore) Publish(id, targetPath string) error {
+	if err := s.mem.Publish(id, targetPath); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+func (s *fileVolumeStore) Unpublish(id string) error {
+	if err := s.mem.Unpublish(id); err != nil {
+		return err
+	}
+	return s.persist()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/container-storage-interface/examples/gocsi/csp/moc/csi"
+)
+
+const (
+	// EnvVarNodeRegion and EnvVarNodeZone set this node's accessible
+	// topology, returned from GetNodeID and consulted by
+	// ControllerPublishVolume. Unset means the node carries no topology
+	// segments and is considered accessible from every volume.
+	EnvVarNodeRegion = "X_CSI_MOCK_NODE_REGION"
+	EnvVarNodeZone   = "X_CSI_MOCK_NODE_ZONE"
+
+	// EnvVarMaxVolumesPerNode sets the MaxVolumesPerNode GetNodeID
+	// reports, so a scheduler back-pressure test can configure it
+	// without recompiling the mock. Unset/zero means unlimited.
+	EnvVarMaxVolumesPerNode = "X_CSI_MOCK_MAX_VOLUMES_PER_NODE"
+
+	// topologyKeyRegion and topologyKeyZone are the well-known topology
+	// segment keys this mock understands, domain-qualified the way real
+	// topology keys (e.g. topology.kubernetes.io/zone) are.
+	topologyKeyRegion = "topology.mock.csi/region"
+	topologyKeyZone   = "topology.mock.csi/zone"
+)
+
+var (
+	nodeTopology      = topologyFromEnv()
+	maxVolumesPerNode = maxVolumesPerNodeFromEnv()
+)
+
+// topologyFromEnv builds this node's accessible topology from
+// EnvVarNodeRegion/EnvVarNodeZone, or nil if neither is set.
+func topologyFromEnv() *csi.Topology {
+	segments := map[string]string{}
+	if r := os.Getenv(EnvVarNodeRegion); r != "" {
+		segments[topologyKeyRegion] = r
+	}
+	if z := os.Getenv(EnvVarNodeZone); z != "" {
+		segments[topologyKeyZone] = z
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	return &csi.Topology{Segments: segments}
+}
+
+func maxVolumesPerNodeFromEnv() int64 {
+	s := os.Getenv(EnvVarMaxVolumesPerNode)
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// chooseTopology picks the topology CreateVolume records on a new
+// volume from the CO's AccessibilityRequirements: the first preferred
+// segment if one was supplied, otherwise the first requisite segment,
+// otherwise nil for a volume with no topology constraint.
+func chooseTopology(reqs *csi.TopologyRequirement) []*csi.Topology {
+	if reqs == nil {
+		return nil
+	}
+	if p := reqs.GetPreferred(); len(p) > 0 {
+		return []*csi.Topology{p[0]}
+	}
+	if r := reqs.GetRequisite(); len(r) > 0 {
+		return []*csi.Topology{r[0]}
+	}
+	return nil
+}
+
+// nodeAccessibleTo reports whether requestedNodeID can reach a volume
+// whose AccessibleTopology is volTopology. This mock is a single
+// combined controller+node process advertising one NodeID (nodeIDID)
+// and one topology (nodeTopology, from EnvVarNodeRegion/EnvVarNodeZone),
+// so requestedNodeID must name that node - any other value can't
+// possibly be accessible, since this process has no registry of other
+// nodes' topology to check it against. For the one node it does know,
+// the volume must carry no topology constraint, or nodeTopology must
+// agree with at least one of the volume's segments on every key the
+// node itself supplies; a node with no configured topology.* values
+// (nodeTopology nil) is treated as able to reach any volume.
+func nodeAccessibleTo(requestedNodeID string, volTopology []*csi.Topology) bool {
+	if requestedNodeID != nodeIDID {
+		return false
+	}
+	if len(volTopology) == 0 {
+		return true
+	}
+	for _, t := range volTopology {
+		if segmentsCompatible(nodeTopology.GetSegments(), t.GetSegments()) {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentsCompatible reports whether nodeValues disagrees with none of
+// segments' keys it also supplies.
+func segmentsCompatible(nodeValues, segments map[string]string) bool {
+	for k, want := range segments {
+		if got, ok := nodeValues[k]; ok && got != want {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package gocsi
+
+import (
+	"net"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// embeddedBufSize is the in-memory buffer bufconn.Listen allocates for
+// an EmbeddedServe connection. CSI requests/responses are small, so the
+// default used by most bufconn-based tests is more than enough.
+const embeddedBufSize = 1024 * 1024
+
+// EmbeddedServe boots s against an in-memory bufconn.Listener instead of
+// a unix socket or TCP listener, and returns a *grpc.ClientConn already
+// dialed to it. It registers all three CSI services and honors
+// s.Services routing via the csi.service metadata key exactly as Serve
+// does - the only difference is there's no filesystem socket or port to
+// allocate - so Go tests and other in-process embedders can stand up a
+// gocsi mock driver the way Kubernetes e2e embeds csi-mock-driver.
+//
+// EmbeddedServe returns once the server is up; callers stop it with the
+// usual Stop/GracefulStop.
+func (s *Server) EmbeddedServe(ctx context.Context) (*grpc.ClientConn, error) {
+	lis := bufconn.Listen(embeddedBufSize)
+	if err := s.Start(ctx, lis); err != nil {
+		return nil, err
+	}
+
+	return grpc.DialContext(ctx, "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+		grpc.WithInsecure(),
+		grpc.WithBlock())
+}
@@ -0,0 +1,131 @@
+package gocsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/container-storage-interface/examples/gocsi/csi"
+)
+
+// EphemeralVolumeAttribute is the well-known volume attribute a CO sets
+// on a NodePublishVolumeRequest to request an ephemeral inline volume -
+// one whose lifecycle is scoped to the workload rather than provisioned
+// ahead of time via CreateVolume/ControllerPublishVolume.
+const EphemeralVolumeAttribute = "csi.storage.k8s.io/ephemeral"
+
+// controllerCapabilityCreateDeleteVolume is the
+// ControllerServiceCapability_RPC Type value for CREATE_DELETE_VOLUME. A
+// Service requires it be advertised before honoring an ephemeral
+// NodePublishVolumeRequest, since SynthesizeEphemeralVolume performs the
+// equivalent of a CreateVolume.
+const controllerCapabilityCreateDeleteVolume = 1
+
+// EphemeralProvider is implemented by a ServiceProvider that can
+// synthesize and tear down its own ephemeral inline volumes. A Service
+// checks for this interface on its underlying ServiceProvider, and that
+// its Controller advertises CREATE_DELETE_VOLUME, before honoring an
+// ephemeral NodePublishVolumeRequest; a provider that doesn't implement
+// it, or doesn't advertise the capability, never sees ephemeral requests
+// and the CO should fall back to its own node-local provisioning.
+type EphemeralProvider interface {
+	// SynthesizeEphemeralVolume performs the equivalent of a
+	// CreateVolume (and, if the provider advertises
+	// CREATE_DELETE_VOLUME, a ControllerPublishVolume) for the inline
+	// volume described by req, returning the resulting VolumeID.
+	SynthesizeEphemeralVolume(
+		ctx context.Context,
+		req *csi.NodePublishVolumeRequest) (*csi.VolumeID, error)
+
+	// TeardownEphemeralVolume reverses SynthesizeEphemeralVolume.
+	TeardownEphemeralVolume(ctx context.Context, id *csi.VolumeID) error
+}
+
+// isEphemeralRequest reports whether req's volume attributes request an
+// ephemeral inline volume.
+func isEphemeralRequest(req *csi.NodePublishVolumeRequest) bool {
+	return req.GetVolumeAttributes()[EphemeralVolumeAttribute] == "true"
+}
+
+// ephemeralState tracks the synthesized VolumeID for each target path an
+// ephemeral volume was published to, persisted to a JSON file on disk so
+// NodeUnpublishVolume can reverse the chain even across a process
+// restart.
+type ephemeralState struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newEphemeralState(stateDir string) *ephemeralState {
+	return &ephemeralState{path: filepath.Join(stateDir, "ephemeral.json")}
+}
+
+func (e *ephemeralState) record(targetPath string, id *csi.VolumeID) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	all, err := e.load()
+	if err != nil {
+		return err
+	}
+	all[targetPath] = id.GetValues()
+	return e.save(all)
+}
+
+func (e *ephemeralState) lookup(targetPath string) (*csi.VolumeID, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	all, err := e.load()
+	if err != nil {
+		return nil, err
+	}
+	values, ok := all[targetPath]
+	if !ok {
+		return nil, nil
+	}
+	return &csi.VolumeID{Values: values}, nil
+}
+
+func (e *ephemeralState) forget(targetPath string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	all, err := e.load()
+	if err != nil {
+		return err
+	}
+	delete(all, targetPath)
+	return e.save(all)
+}
+
+func (e *ephemeralState) load() (map[string]map[string]string, error) {
+	data, err := ioutil.ReadFile(e.path)
+	if os.IsNotExist(err) {
+		return map[string]map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gocsi: read ephemeral state: %v", err)
+	}
+	all := map[string]map[string]string{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("gocsi: parse ephemeral state: %v", err)
+	}
+	return all, nil
+}
+
+func (e *ephemeralState) save(all map[string]map[string]string) error {
+	data, err := json.Marshal(all)
+	if err != nil {
+		return fmt.Errorf("gocsi: marshal ephemeral state: %v", err)
+	}
+	if err := ioutil.WriteFile(e.path, data, 0600); err != nil {
+		return fmt.Errorf("gocsi: write ephemeral state: %v", err)
+	}
+	return nil
+}
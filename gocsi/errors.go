@@ -0,0 +1,90 @@
+package gocsi
+
+import (
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CSIError is implemented by errors a Service's ServiceProvider returns
+// from a Controller/Identity/Node method to distinguish a transient
+// condition the CO should retry - e.g. a lost connection to a
+// controller instance - from a permanent one. The server (see
+// server.go) checks for it on every error it forwards and translates it
+// into the matching gRPC status code, rather than letting every
+// ServiceProvider return raw errors the CO has no way to act on.
+type CSIError interface {
+	error
+
+	// Retryable reports whether the CO should retry the call, typically
+	// against another controller instance, rather than treat the
+	// operation as permanently failed.
+	Retryable() bool
+
+	// Reason is a short, machine-readable string attached to the
+	// returned status as an errdetails.ErrorInfo, so an automated
+	// caller can branch on it without parsing Error().
+	Reason() string
+}
+
+// csiError is the concrete CSIError RetryableErrorf and TerminalErrorf
+// construct.
+type csiError struct {
+	err       error
+	retryable bool
+	reason    string
+}
+
+func (e *csiError) Error() string   { return e.err.Error() }
+func (e *csiError) Retryable() bool { return e.retryable }
+func (e *csiError) Reason() string  { return e.reason }
+
+// RetryableErrorf formats a CSIError the server translates to
+// codes.Unavailable, telling the CO the condition is transient and it
+// should retry - against another controller instance, if one is
+// available - rather than fail the operation outright.
+func RetryableErrorf(reason, format string, a ...interface{}) error {
+	return &csiError{err: fmt.Errorf(format, a...), retryable: true, reason: reason}
+}
+
+// TerminalErrorf formats a CSIError the server translates to
+// codes.FailedPrecondition, telling the CO the condition won't clear on
+// retry.
+func TerminalErrorf(reason, format string, a ...interface{}) error {
+	return &csiError{err: fmt.Errorf(format, a...), retryable: false, reason: reason}
+}
+
+// ErrCSIPluginUnavailable is the sentinel a ServiceProvider should
+// return - or wrap via RetryableErrorf - when it can't be reached at
+// all, e.g. dialController failed to connect. It mirrors the
+// ErrCSIClientRPCRetryable/ErrCSIClientRPCIgnorable split Nomad uses for
+// exactly this purpose.
+var ErrCSIPluginUnavailable = RetryableErrorf("plugin-unavailable", "gocsi: plugin unavailable")
+
+// toStatusErr translates the error returned by a Service's
+// Controller/Identity/Node method into a gRPC status error. A CSIError
+// becomes codes.Unavailable (Retryable) or codes.FailedPrecondition
+// (terminal), carrying Reason as an errdetails.ErrorInfo detail; any
+// other error - including nil - passes through unchanged, so
+// ServiceProviders that still return the repo's envelope-style errors
+// keep behaving exactly as before.
+func toStatusErr(err error) error {
+	cerr, ok := err.(CSIError)
+	if !ok {
+		return err
+	}
+
+	code := codes.FailedPrecondition
+	if cerr.Retryable() {
+		code = codes.Unavailable
+	}
+
+	st, derr := status.New(code, cerr.Error()).WithDetails(
+		&errdetails.ErrorInfo{Reason: cerr.Reason()})
+	if derr != nil {
+		return status.Error(code, cerr.Error())
+	}
+	return st.Err()
+}
@@ -0,0 +1,189 @@
+package gocsi
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+
+	"github.com/container-storage-interface/examples/gocsi/csi"
+)
+
+// Environment variables consulted when MetricsAddr/LivenessAddr are left
+// unset on a Server, mirroring the CSI_ENDPOINT convention already used
+// for the primary listener.
+const (
+	EnvVarMetricsAddr  = "CSI_METRICS_ADDR"
+	EnvVarLivenessAddr = "CSI_LIVENESS_ADDR"
+)
+
+var (
+	rpcLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gocsi",
+		Name:      "rpc_duration_seconds",
+		Help:      "Latency of CSI RPCs dispatched through a gocsi.Service.",
+	}, []string{"rpc"})
+
+	rpcInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gocsi",
+		Name:      "rpc_in_flight",
+		Help:      "Number of CSI RPCs currently being dispatched.",
+	}, []string{"rpc"})
+
+	rpcErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gocsi",
+		Name:      "rpc_errors_total",
+		Help:      "Count of CSI RPCs that returned an error.",
+	}, []string{"rpc"})
+)
+
+func init() {
+	prometheus.MustRegister(rpcLatency, rpcInFlight, rpcErrors)
+}
+
+// MetricsInterceptor is a gocsi.Interceptor that records per-RPC latency,
+// in-flight count, and error totals to the gocsi Prometheus registry. It
+// is intended to be attached via WithInterceptors so the sidecar HTTP
+// server's /metrics endpoint has data to serve.
+func MetricsInterceptor(
+	ctx context.Context, rpc string, req interface{}, next Invoker,
+) (interface{}, error) {
+
+	rpcInFlight.WithLabelValues(rpc).Inc()
+	defer rpcInFlight.WithLabelValues(rpc).Dec()
+
+	start := time.Now()
+	resp, err := next(ctx, req)
+	rpcLatency.WithLabelValues(rpc).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcErrors.WithLabelValues(rpc).Inc()
+	}
+	return resp, err
+}
+
+// ServeHealth brings up the /metrics, /healthz, and /readyz sidecar
+// endpoints, as configured by s.MetricsAddr/s.LivenessAddr (falling back
+// to CSI_METRICS_ADDR/CSI_LIVENESS_ADDR). /readyz probes the first
+// registered Service over its own PipeConn by issuing
+// GetSupportedVersions and, unless the Service reports itself
+// Controller-only, ProbeNode - so a Kubernetes liveness probe can detect a hung Node
+// plugin without an out-of-process helper.
+//
+// When MetricsAddr and LivenessAddr are both set to different
+// addresses - the way ceph-csi and csi-driver-smb separate the
+// metrics-scrape endpoint from the kubelet's liveness probe - /metrics
+// gets its own listener on MetricsAddr and /healthz+/readyz get their
+// own on LivenessAddr. Otherwise every endpoint shares one listener.
+//
+// ServeHealth returns immediately; every listener it starts is tracked
+// by s.wg and runs until ctx is canceled, at which point it is shut
+// down.
+func (s *Server) ServeHealth(ctx context.Context) error {
+	metricsAddr := s.MetricsAddr
+	if metricsAddr == "" {
+		metricsAddr = os.Getenv(EnvVarMetricsAddr)
+	}
+	livenessAddr := s.LivenessAddr
+	if livenessAddr == "" {
+		livenessAddr = os.Getenv(EnvVarLivenessAddr)
+	}
+	if metricsAddr == "" && livenessAddr == "" {
+		return nil
+	}
+
+	healthzHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	readyzHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.probe(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	if metricsAddr != "" && livenessAddr != "" && metricsAddr != livenessAddr {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		if err := s.serveSidecar(ctx, metricsAddr, metricsMux); err != nil {
+			return err
+		}
+
+		livenessMux := http.NewServeMux()
+		livenessMux.Handle("/healthz", healthzHandler)
+		livenessMux.Handle("/readyz", readyzHandler)
+		return s.serveSidecar(ctx, livenessAddr, livenessMux)
+	}
+
+	addr := metricsAddr
+	if addr == "" {
+		addr = livenessAddr
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthzHandler)
+	mux.Handle("/readyz", readyzHandler)
+	return s.serveSidecar(ctx, addr, mux)
+}
+
+// serveSidecar brings up one HTTP listener on addr serving mux, appended
+// to s.hs so Stop/GracefulStop close it, and with its shutdown-watcher
+// and Serve goroutines both tracked by s.wg so Done isn't closed until
+// this listener has actually exited.
+func (s *Server) serveSidecar(ctx context.Context, addr string, mux *http.ServeMux) error {
+	hs := &http.Server{Addr: addr, Handler: mux}
+	s.hs = append(s.hs, hs)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		<-ctx.Done()
+		hs.Close()
+	}()
+	go func() {
+		defer s.wg.Done()
+		hs.Serve(ln)
+	}()
+	return nil
+}
+
+// probe issues GetSupportedVersions, and ProbeNode unless the Service
+// reports itself Controller-only, against the first registered Service.
+func (s *Server) probe(ctx context.Context) error {
+	if len(s.Services) == 0 {
+		return fmt.Errorf("gocsi: no services registered")
+	}
+	svc := s.Services[0]
+
+	conn, err := svc.Dial(ctx)
+	if err != nil {
+		return fmt.Errorf("gocsi: dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	ident := csi.NewIdentityClient(conn)
+	if _, err := ident.GetSupportedVersions(
+		ctx, &csi.GetSupportedVersionsRequest{}); err != nil {
+		return fmt.Errorf("gocsi: GetSupportedVersions failed: %v", err)
+	}
+
+	if svc.ControllerOnly() {
+		return nil
+	}
+
+	node := csi.NewNodeClient(conn)
+	if _, err := node.ProbeNode(ctx, &csi.ProbeNodeRequest{}); err != nil {
+		return fmt.Errorf("gocsi: ProbeNode failed: %v", err)
+	}
+	return nil
+}
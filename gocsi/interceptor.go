@@ -0,0 +1,246 @@
+package gocsi
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// Invoker performs the actual dial-and-dispatch of a single RPC against
+// the Service's wrapped ServiceProvider. It is the innermost link in an
+// Interceptor chain.
+type Invoker func(ctx context.Context, req interface{}) (interface{}, error)
+
+// Interceptor wraps the invocation of a single RPC dispatched by a
+// Service, in the spirit of grpc.UnaryClientInterceptor, except it is
+// keyed by RPC name rather than a generated method descriptor since
+// Service talks to its ServiceProvider through hand-written wrappers
+// rather than a client stub. Cross-cutting concerns - logging, tracing,
+// retry, per-call timeouts, panic recovery, auth propagation - belong
+// here rather than in the individual Controller/Identity/Node methods.
+type Interceptor func(
+	ctx context.Context, rpc string, req interface{}, next Invoker) (interface{}, error)
+
+// chainInterceptors composes interceptors into a single dispatch function
+// that invokes them in order, each wrapping the next, with the eventual
+// Invoker passed to dispatch as the innermost call.
+func chainInterceptors(
+	interceptors []Interceptor,
+) func(ctx context.Context, rpc string, req interface{}, invoke Invoker) (interface{}, error) {
+
+	return func(
+		ctx context.Context, rpc string, req interface{}, invoke Invoker,
+	) (interface{}, error) {
+
+		next := invoke
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			ic, cur := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return ic(ctx, rpc, req, cur)
+			}
+		}
+		return next(ctx, req)
+	}
+}
+
+// ServiceOption configures a Service created via NewServiceWithOptions.
+type ServiceOption func(*service)
+
+// WithVersionPolicy configures the VersionPolicy a Service's
+// VersionSelector uses to validate request versions. The default,
+// applied by NewService, is VersionExact.
+func WithVersionPolicy(policy VersionPolicy) ServiceOption {
+	return func(s *service) {
+		s.versionSelector.Policy = policy
+	}
+}
+
+// WithInterceptors prepends one or more Interceptors to the chain every
+// Controller/Identity/Node RPC is routed through. User-supplied
+// interceptors run outermost, wrapping the built-in version-enforcement,
+// idempotency, tracing, and request-logging interceptors that are always
+// present.
+func WithInterceptors(interceptors ...Interceptor) ServiceOption {
+	return func(s *service) {
+		s.interceptors = append(append([]Interceptor{}, interceptors...), s.interceptors...)
+	}
+}
+
+// WithIdempotencyTTL overrides the TTL of the built-in IdempotencyCache
+// from its DefaultIdempotencyTTL, or disables it entirely when ttl is 0.
+func WithIdempotencyTTL(ttl time.Duration) ServiceOption {
+	return func(s *service) {
+		if ttl == 0 {
+			s.idempotency = nil
+		} else {
+			s.idempotency = NewIdempotencyCache(ttl)
+		}
+	}
+}
+
+// NewServiceWithOptions is like NewService but allows callers to attach
+// additional Interceptors (tracing, retry, idempotency, secrets, etc) to
+// the returned Service.
+func NewServiceWithOptions(
+	ctx context.Context,
+	serviceType, serviceName string,
+	opts ...ServiceOption) (Service, error) {
+
+	svc, err := NewService(ctx, serviceType, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	s := svc.(*service)
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.rebuildDispatch()
+	return s, nil
+}
+
+// rebuildDispatch recomposes s.dispatch from s.interceptors. It is called
+// once by NewService with the built-in interceptors and again by
+// NewServiceWithOptions after user interceptors have been prepended.
+func (s *service) rebuildDispatch() {
+	s.dispatch = chainInterceptors(s.interceptors)
+}
+
+// versionInterceptor is the default interceptor enforcing that a
+// request's version is one the ServiceProvider advertises. It replaces
+// the chkReqVersion call that used to be hand-rolled at the top of every
+// wrapper method.
+func (s *service) versionInterceptor(
+	ctx context.Context, rpc string, req interface{}, next Invoker,
+) (interface{}, error) {
+
+	if hgv, ok := req.(hasGetVersion); ok {
+		if v := s.chkReqVersion(ctx, hgv); len(v) != 0 {
+			return nil, &versionError{rpc: rpc, reason: v}
+		}
+	}
+	return next(ctx, req)
+}
+
+// versionError is returned by versionInterceptor when a request's
+// version isn't one the ServiceProvider advertises. Each RPC wrapper in
+// service.go translates it into its own ErrXxxGeneral response, since
+// every CSI RPC has a distinct response envelope.
+type versionError struct {
+	rpc    string
+	reason string
+}
+
+func (e *versionError) Error() string {
+	return fmt.Sprintf(
+		"%s: unsupported request version: %s", e.rpc, e.reason)
+}
+
+// requestLoggingInterceptor logs the RPC name and duration of every
+// dispatched call. It never logs the request itself, so volume IDs and
+// any future credential material never reach the log verbatim.
+func requestLoggingInterceptor(
+	ctx context.Context, rpc string, req interface{}, next Invoker,
+) (interface{}, error) {
+
+	start := time.Now()
+	resp, err := next(ctx, req)
+	log.Printf("%s took %s, err=%v\n", rpc, time.Since(start), err)
+	return resp, err
+}
+
+// tracingInterceptor starts an OpenTracing span named after rpc for
+// every dispatched call, finishing it once next returns and recording
+// the error as a span tag if one occurred. It uses
+// opentracing.GlobalTracer(), so a ServiceProvider's process wires up
+// Jaeger, Zipkin, or any other OpenTracing-compatible backend by
+// calling opentracing.SetGlobalTracer during its own startup; this
+// package takes no dependency on a specific one.
+func tracingInterceptor(
+	ctx context.Context, rpc string, req interface{}, next Invoker,
+) (interface{}, error) {
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, rpc)
+	defer span.Finish()
+
+	resp, err := next(ctx, req)
+	if err != nil {
+		span.SetTag("error", true)
+		span.LogKV("error.message", err.Error())
+	}
+	return resp, err
+}
+
+// DefaultIdempotencyTTL is the TTL NewService gives the built-in
+// IdempotencyCache. Override it with WithIdempotencyTTL.
+const DefaultIdempotencyTTL = 5 * time.Minute
+
+// idempotencyInterceptor is the default interceptor deduplicating
+// CreateVolume retries. It reads s.idempotency on every call, rather than
+// closing over a single *IdempotencyCache, so WithIdempotencyTTL can
+// swap the cache out (or disable it) regardless of interceptor chain
+// ordering.
+func (s *service) idempotencyInterceptor(
+	ctx context.Context, rpc string, req interface{}, next Invoker,
+) (interface{}, error) {
+
+	if s.idempotency == nil {
+		return next(ctx, req)
+	}
+	return s.idempotency.Interceptor()(ctx, rpc, req, next)
+}
+
+// IdempotencyCache deduplicates CreateVolume retries keyed on the
+// request's Name, returning the original response verbatim for a
+// configurable TTL so repeated retries from an external-provisioner
+// client observe exactly-once semantics.
+type IdempotencyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	resp    interface{}
+	expires time.Time
+}
+
+// NewIdempotencyCache returns an IdempotencyCache whose entries expire
+// after ttl.
+func NewIdempotencyCache(ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{ttl: ttl, entries: map[string]idempotencyEntry{}}
+}
+
+// Interceptor returns an Interceptor that, for CreateVolumeRequests,
+// short-circuits to a cached response when one exists for the request's
+// Name, and otherwise caches whatever response next returns.
+func (c *IdempotencyCache) Interceptor() Interceptor {
+	return func(ctx context.Context, rpc string, req interface{}, next Invoker) (interface{}, error) {
+		named, ok := req.(interface{ GetName() string })
+		if rpc != "CreateVolume" || !ok {
+			return next(ctx, req)
+		}
+
+		name := named.GetName()
+
+		c.mu.Lock()
+		e, found := c.entries[name]
+		c.mu.Unlock()
+		if found && time.Now().Before(e.expires) {
+			return e.resp, nil
+		}
+
+		resp, err := next(ctx, req)
+		if err == nil {
+			c.mu.Lock()
+			c.entries[name] = idempotencyEntry{resp: resp, expires: time.Now().Add(c.ttl)}
+			c.mu.Unlock()
+		}
+		return resp, err
+	}
+}
@@ -0,0 +1,80 @@
+// Package middleware provides ready-made grpc.UnaryServerInterceptors
+// for attaching to a gocsi.Server's UnaryInterceptors field: request
+// logging, metrics, panic recovery, and request-ID propagation. They
+// operate on the raw gRPC request/response, ahead of the per-Service
+// Interceptor chain gocsi itself builds around the hand-wrapped CSI
+// types.
+package middleware
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/container-storage-interface/examples/gocsi"
+)
+
+// redactedFieldNames lists the struct field names UnaryServerLogging
+// strips from a request before logging it. UserCredentials is redacted
+// field-by-field via gocsi.Redact, since it may carry other, non-secret
+// material worth keeping in the log; Secrets has no well-known shape so
+// it is blanked wholesale.
+var redactedFieldNames = []string{"UserCredentials", "Secrets"}
+
+// UnaryServerLogging returns a grpc.UnaryServerInterceptor that logs the
+// full method name, duration, and error of every unary RPC. The logged
+// request is first passed through redact, so the UserCredentials fields
+// gocsi.Redact masks, and every Secrets value, are never written to the
+// log verbatim. Other UserCredentials fields are logged as they are.
+func UnaryServerLogging() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		log.Printf("%s took %s request=%+v err=%v\n",
+			info.FullMethod, time.Since(start), redact(req), err)
+		return resp, err
+	}
+}
+
+// redact returns a shallow copy of msg with the fields named in
+// redactedFieldNames masked - UserCredentials via gocsi.Redact, Secrets by
+// replacing every value with "***" - in the spirit of protosanitizer's
+// secret-stripping but driven by field name rather than a proto option,
+// since this repo's CSI types aren't generated with one.
+func redact(msg interface{}) interface{} {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return msg
+	}
+
+	cp := reflect.New(v.Elem().Type())
+	cp.Elem().Set(v.Elem())
+
+	for _, name := range redactedFieldNames {
+		f := cp.Elem().FieldByName(name)
+		if !f.IsValid() || !f.CanSet() || f.Kind() != reflect.Map {
+			continue
+		}
+
+		if name == "UserCredentials" {
+			if creds, ok := f.Interface().(map[string]string); ok {
+				f.Set(reflect.ValueOf(gocsi.Redact(creds)))
+			}
+			continue
+		}
+
+		redacted := reflect.MakeMap(f.Type())
+		for _, k := range f.MapKeys() {
+			redacted.SetMapIndex(k, reflect.ValueOf("***").Convert(f.Type().Elem()))
+		}
+		f.Set(redacted)
+	}
+
+	return cp.Interface()
+}
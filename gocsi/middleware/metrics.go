@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+var (
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gocsi",
+		Subsystem: "grpc",
+		Name:      "rpc_duration_seconds",
+		Help:      "Latency of unary RPCs handled by a gocsi.Server.",
+	}, []string{"method"})
+
+	rpcTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gocsi",
+		Subsystem: "grpc",
+		Name:      "rpc_total",
+		Help:      "Count of unary RPCs handled by a gocsi.Server, by method and error status.",
+	}, []string{"method", "error"})
+)
+
+func init() {
+	prometheus.MustRegister(rpcDuration, rpcTotal)
+}
+
+// UnaryServerMetrics returns a grpc.UnaryServerInterceptor that records
+// per-method latency and error counts to the same Prometheus registry
+// gocsi.ServeHealth's /metrics endpoint serves.
+func UnaryServerMetrics() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		rpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+		rpcTotal.WithLabelValues(info.FullMethod, errLabel(err)).Inc()
+		return resp, err
+	}
+}
+
+func errLabel(err error) string {
+	if err == nil {
+		return "false"
+	}
+	return "true"
+}
@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerRecovery returns a grpc.UnaryServerInterceptor that recovers
+// a panicking handler, logs the panic value and a stack trace, and turns
+// it into a codes.Internal error rather than crashing the process and
+// taking down every other in-flight RPC with it.
+func UnaryServerRecovery() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (resp interface{}, err error) {
+
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("panic handling %s: %v\n%s", info.FullMethod, r, debug.Stack())
+				err = status.Error(codes.Internal, fmt.Sprintf("panic: %v", r))
+			}
+		}()
+
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestIDKey is the incoming/outgoing gRPC metadata key
+// UnaryServerRequestID consults, so a CO or proxy can supply its own
+// correlation ID for a call rather than always getting a generated one.
+const RequestIDKey = "csi.request-id"
+
+type requestIDKey struct{}
+
+// RequestID returns the request ID UnaryServerRequestID attached to ctx,
+// or the empty string if the interceptor isn't in the chain.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// UnaryServerRequestID returns a grpc.UnaryServerInterceptor that takes
+// the request ID from incoming RequestIDKey metadata, generating one if
+// none was supplied, and makes it available to later interceptors and
+// handlers via RequestID.
+func UnaryServerRequestID() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+
+		id := requestIDFromMetadata(ctx)
+		if id == "" {
+			id = newRequestID()
+		}
+		return handler(context.WithValue(ctx, requestIDKey{}, id), req)
+	}
+}
+
+func requestIDFromMetadata(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	vs := md[RequestIDKey]
+	if len(vs) == 0 {
+		return ""
+	}
+	return vs[0]
+}
+
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", b)
+}
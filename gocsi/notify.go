@@ -0,0 +1,228 @@
+package gocsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+
+	"github.com/container-storage-interface/examples/gocsi/csi"
+)
+
+// VolumeUnmapped is the event a Node Service reports once it has
+// finished unmapping a volume's device, delivered to Controller-side
+// Services (and vice versa) over the NodeControllerNotify sidecar
+// channel every Server registers alongside the CSI services.
+type VolumeUnmapped struct {
+	VolumeID *csi.VolumeID
+	NodeID   *csi.NodeID
+}
+
+// NotifyReceiver is optionally implemented by a Service registered with
+// a Server that wants to react to VolumeUnmapped events - e.g. to stop polling for
+// device rediscovery once the controller confirms the unmap, as the
+// Seagate exos-x driver does - rather than relying solely on the CSI
+// RPCs that triggered them.
+type NotifyReceiver interface {
+	NotifyVolumeUnmapped(ctx context.Context, event *VolumeUnmapped)
+}
+
+// Empty is the NodeControllerNotify channel's ack. It is sent once every
+// NotifyReceiver Service has returned from NotifyVolumeUnmapped, so the
+// sender waits for the receivers to handle the event.
+type Empty struct{}
+
+const (
+	notifyServiceName = "gocsi.NodeControllerNotify"
+	notifyCodecName   = "gocsi-notify-json"
+)
+
+func init() {
+	encoding.RegisterCodec(notifyCodec{})
+}
+
+// notifyCodec is a grpc/encoding.Codec for NodeControllerNotify events,
+// which - unlike the CSI RPC types generated from the CSI proto - aren't
+// proto.Message implementations, so the default "proto" codec can't
+// carry them.
+type notifyCodec struct{}
+
+func (notifyCodec) Marshal(v interface{}) ([]byte, error)   { return json.Marshal(v) }
+func (notifyCodec) Unmarshal(b []byte, v interface{}) error { return json.Unmarshal(b, v) }
+func (notifyCodec) Name() string                            { return notifyCodecName }
+
+type notifyServer interface {
+	NotifyVolumeUnmapped(ctx context.Context, event *VolumeUnmapped) (*Empty, error)
+}
+
+var notifyServiceDesc = grpc.ServiceDesc{
+	ServiceName: notifyServiceName,
+	HandlerType: (*notifyServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "NotifyVolumeUnmapped",
+			Handler:    notifyVolumeUnmappedHandler,
+		},
+	},
+	Metadata: "gocsi/notify.proto",
+}
+
+func notifyVolumeUnmappedHandler(
+	srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor,
+) (interface{}, error) {
+
+	in := new(VolumeUnmapped)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(notifyServer).NotifyVolumeUnmapped(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + notifyServiceName + "/NotifyVolumeUnmapped"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(notifyServer).NotifyVolumeUnmapped(ctx, req.(*VolumeUnmapped))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// notifyServerImpl fans a received VolumeUnmapped event out to every
+// registered Service that implements NotifyReceiver. It is registered
+// against every Server's gRPC server in Start, regardless of whether any
+// Service actually implements NotifyReceiver, so it shares Server's
+// existing graceful-shutdown draining rather than needing its own.
+type notifyServerImpl struct {
+	s *Server
+}
+
+func (n *notifyServerImpl) NotifyVolumeUnmapped(
+	ctx context.Context, event *VolumeUnmapped) (*Empty, error) {
+
+	for _, svc := range n.s.Services {
+		if nr, ok := svc.(NotifyReceiver); ok {
+			nr.NotifyVolumeUnmapped(ctx, event)
+		}
+	}
+	return &Empty{}, nil
+}
+
+const (
+	notifyMinBackoff = 100 * time.Millisecond
+	notifyMaxBackoff = 30 * time.Second
+)
+
+// NotifyClient delivers VolumeUnmapped events to a NodeControllerNotify
+// sidecar over a single, reused grpc.ClientConn, redialing with
+// exponential backoff if the connection is ever lost. A ServiceProvider
+// that wants to notify its Controller- or Node-side counterpart
+// constructs one with NewNotifyClient and should Close it during its own
+// Stop/GracefulStop so in-flight notifications drain before the
+// connection is torn down.
+type NotifyClient struct {
+	addr string
+
+	mu      sync.Mutex
+	conn    *grpc.ClientConn
+	backoff time.Duration
+
+	wg       sync.WaitGroup
+	closing  chan struct{}
+	closeOne sync.Once
+}
+
+// NewNotifyClient returns a NotifyClient that delivers events to the
+// NodeControllerNotify sidecar listening on addr.
+func NewNotifyClient(addr string) *NotifyClient {
+	return &NotifyClient{addr: addr, closing: make(chan struct{})}
+}
+
+// NotifyVolumeUnmapped delivers event to the sidecar, dialing - or
+// redialing, after the configured backoff, if the previous connection
+// was lost - as needed. It is safe to call concurrently; every in-flight
+// call is tracked so Close can drain them before the connection closes.
+func (c *NotifyClient) NotifyVolumeUnmapped(ctx context.Context, event *VolumeUnmapped) error {
+	// wg.Add must happen before the closing check, not after: otherwise
+	// a caller can pass the check right as Close's wg.Wait returns on an
+	// empty count, then Add(1) and dial a brand-new connection that
+	// Close never waits for or closes.
+	c.wg.Add(1)
+	defer c.wg.Done()
+
+	select {
+	case <-c.closing:
+		return fmt.Errorf("gocsi: notify client is closed")
+	default:
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	out := new(Empty)
+	if err := conn.Invoke(
+		ctx, "/"+notifyServiceName+"/NotifyVolumeUnmapped", event, out,
+		grpc.CallContentSubtype(notifyCodecName),
+	); err != nil {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (c *NotifyClient) dial(ctx context.Context) (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		return c.conn, nil
+	}
+
+	if c.backoff > 0 {
+		select {
+		case <-time.After(c.backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	conn, err := grpc.DialContext(ctx, c.addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		if c.backoff == 0 {
+			c.backoff = notifyMinBackoff
+		} else {
+			c.backoff *= 2
+			if c.backoff > notifyMaxBackoff {
+				c.backoff = notifyMaxBackoff
+			}
+		}
+		return nil, fmt.Errorf("gocsi: dial notify sidecar: %v", err)
+	}
+
+	c.backoff = 0
+	c.conn = conn
+	return conn, nil
+}
+
+// Close waits for every in-flight NotifyVolumeUnmapped call to finish
+// before closing the underlying connection, so a caller's shutdown path
+// never tears the connection down out from under a notification still
+// being delivered.
+func (c *NotifyClient) Close() error {
+	c.closeOne.Do(func() { close(c.closing) })
+	c.wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
@@ -0,0 +1,198 @@
+// Package sanity provides a Ginkgo-based conformance suite that exercises
+// a gocsi.Service the same way the external csi-sanity binary exercises a
+// plug-in over a socket, except the suite dials the Service's in-memory
+// PipeConn directly. Provider authors can add a single `*_test.go` file
+// that calls Test to get spec coverage without standing up a separate
+// csi-sanity process.
+package sanity
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/container-storage-interface/examples/gocsi"
+	"github.com/container-storage-interface/examples/gocsi/csi"
+)
+
+// Test runs the conformance suite against svc using Go's testing package.
+// It is the entry point provider authors wire into a `*_test.go` file,
+// e.g.:
+//
+//     func TestSanity(t *testing.T) {
+//         svc, _ := gocsi.NewService(context.Background(), "mock", "mock")
+//         sanity.Test(t, svc)
+//     }
+func Test(t *testing.T, svc gocsi.Service) {
+	gomega.RegisterFailHandler(ginkgo.Fail)
+	describe(svc)
+	ginkgo.RunSpecs(t, fmt.Sprintf("%s sanity suite", svc.Name()))
+}
+
+// describe registers the conformance specs for svc. It is split out of
+// Test so the specs can also be embedded in a larger Ginkgo suite.
+func describe(svc gocsi.Service) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		ctrl   csi.ControllerClient
+		ident  csi.IdentityClient
+		node   csi.NodeClient
+		conn   *grpc.ClientConn
+
+		serveCtx    context.Context
+		serveCancel context.CancelFunc
+	)
+
+	// svc.Serve is started once for the whole suite, not per spec: its
+	// own guard makes every BeforeEach after the first a no-op anyway,
+	// so starting it per spec just leaked the one real gRPC server and
+	// its listener goroutine for the life of the process. BeforeSuite/
+	// AfterSuite give it a matching, explicit teardown.
+	ginkgo.BeforeSuite(func() {
+		serveCtx, serveCancel = context.WithCancel(context.Background())
+		go svc.Serve(serveCtx, nil)
+	})
+
+	ginkgo.AfterSuite(func() {
+		svc.Stop(serveCtx)
+		serveCancel()
+	})
+
+	ginkgo.BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		var err error
+		conn, err = svc.Dial(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		ctrl = csi.NewControllerClient(conn)
+		ident = csi.NewIdentityClient(conn)
+		node = csi.NewNodeClient(conn)
+	})
+
+	ginkgo.AfterEach(func() {
+		conn.Close()
+		cancel()
+	})
+
+	ginkgo.Describe("Identity Service", func() {
+		ginkgo.It("should reject an unsupported request version", func() {
+			r, err := ident.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{
+				Version: &csi.Version{Major: 99, Minor: 99, Patch: 99},
+			})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gerr := r.GetError().GetGeneralError()
+			gomega.Expect(gerr).ToNot(gomega.BeNil())
+			gomega.Expect(gerr.GetErrorCode()).To(gomega.Equal(
+				csi.Error_GeneralError_UNSUPPORTED_REQUEST_VERSION))
+		})
+	})
+
+	ginkgo.Describe("Controller Service", func() {
+		ginkgo.It("should be idempotent on repeated CreateVolume calls", func() {
+			req := &csi.CreateVolumeRequest{
+				Version: supportedVersion(ident, ctx),
+				Name:    "sanity-idempotent-volume",
+			}
+			r1, err := ctrl.CreateVolume(ctx, req)
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			r2, err := ctrl.CreateVolume(ctx, req)
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gomega.Expect(r1.GetResult().GetVolumeInfo().GetId()).To(
+				gomega.Equal(r2.GetResult().GetVolumeInfo().GetId()))
+		})
+
+		ginkgo.It("should reject CreateVolume with a missing name", func() {
+			req := &csi.CreateVolumeRequest{
+				Version: supportedVersion(ident, ctx),
+			}
+			r, err := ctrl.CreateVolume(ctx, req)
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gomega.Expect(r.GetError().GetCreateVolumeError().GetErrorCode()).To(
+				gomega.Equal(csi.Error_CreateVolumeError_INVALID_VOLUME_NAME))
+		})
+
+		ginkgo.It("should report controller capabilities via ControllerGetCapabilities", func() {
+			r, err := ctrl.ControllerGetCapabilities(
+				ctx, &csi.ControllerGetCapabilitiesRequest{
+					Version: supportedVersion(ident, ctx),
+				})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gomega.Expect(r.GetResult().GetCapabilities()).ToNot(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should paginate ListVolumes", func() {
+			r, err := ctrl.ListVolumes(ctx, &csi.ListVolumesRequest{
+				Version:    supportedVersion(ident, ctx),
+				MaxEntries: 1,
+			})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gomega.Expect(len(r.GetResult().GetEntries())).To(
+				gomega.BeNumerically("<=", 1))
+		})
+	})
+
+	ginkgo.Describe("Node Service", func() {
+		ginkgo.It("should round-trip NodePublishVolume/NodeUnpublishVolume", func() {
+			cv, err := ctrl.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Version: supportedVersion(ident, ctx),
+				Name:    "sanity-node-roundtrip-volume",
+			})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			id := cv.GetResult().GetVolumeInfo().GetId()
+			gomega.Expect(id).ToNot(gomega.BeNil())
+
+			pr, err := node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+				Version:    supportedVersion(ident, ctx),
+				VolumeId:   id,
+				TargetPath: "/tmp/sanity-target",
+			})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gomega.Expect(pr.GetError()).To(gomega.BeNil())
+
+			ur, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+				Version:  supportedVersion(ident, ctx),
+				VolumeId: id,
+			})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gomega.Expect(ur.GetError()).To(gomega.BeNil())
+		})
+
+		ginkgo.It("should synthesize and tear down an ephemeral inline volume", func() {
+			pr, err := node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+				Version:    supportedVersion(ident, ctx),
+				TargetPath: "/tmp/sanity-ephemeral-target",
+				VolumeAttributes: map[string]string{
+					gocsi.EphemeralVolumeAttribute: "true",
+				},
+			})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gomega.Expect(pr.GetError()).To(gomega.BeNil())
+
+			ur, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+				Version:    supportedVersion(ident, ctx),
+				TargetPath: "/tmp/sanity-ephemeral-target",
+			})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gomega.Expect(ur.GetError()).To(gomega.BeNil())
+		})
+	})
+}
+
+// supportedVersion asks the Identity service for its first supported
+// version so the rest of the suite can issue well-formed requests
+// without hard-coding a version number.
+func supportedVersion(ident csi.IdentityClient, ctx context.Context) *csi.Version {
+	r, err := ident.GetSupportedVersions(ctx, &csi.GetSupportedVersionsRequest{})
+	if err != nil {
+		return nil
+	}
+	vs := r.GetResult().GetSupportedVersions()
+	if len(vs) == 0 {
+		return nil
+	}
+	return vs[0]
+}
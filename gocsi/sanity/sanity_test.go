@@ -0,0 +1,22 @@
+package sanity_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/container-storage-interface/examples/gocsi"
+	"github.com/container-storage-interface/examples/gocsi/sanity"
+)
+
+// TestSanity is the go test entry point for the conformance suite,
+// exercised against the mock ServiceProvider so it runs in CI without
+// a real backend. This is the wiring Test's doc comment describes
+// provider authors adding to their own *_test.go file.
+func TestSanity(t *testing.T) {
+	svc, err := gocsi.NewService(context.Background(), "mock", "mock")
+	if err != nil {
+		t.Fatalf("new mock service: %v", err)
+	}
+	sanity.Test(t, svc)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
@@ -30,28 +31,60 @@ type Server struct {
 	// Options are used when creating the gRPC server.
 	Options []grpc.ServerOption
 
-	e chan error
-	g *grpc.Server
-	s *server
-	l net.Listener
-	x []func()
+	// MetricsAddr is the Go network address (host:port) on which the
+	// /metrics sidecar endpoint listens. If empty, the CSI_METRICS_ADDR
+	// environment variable is consulted. Leaving both unset disables it.
+	// If LivenessAddr is empty or equal to MetricsAddr, /healthz and
+	// /readyz are served from this same listener.
+	MetricsAddr string
+
+	// LivenessAddr is the Go network address (host:port) on which the
+	// /healthz and /readyz sidecar endpoints listen. If empty, the
+	// CSI_LIVENESS_ADDR environment variable is consulted; if that's
+	// also empty, they're served from MetricsAddr instead. Set it to a
+	// different address than MetricsAddr to give a Kubernetes liveness
+	// probe its own listener, separate from whatever scrapes /metrics.
+	LivenessAddr string
+
+	// UnaryInterceptors are chained, in order, around every unary RPC the
+	// gRPC server dispatches, ahead of the per-Service Interceptor chain
+	// built in package gocsi. They operate on the raw request/response at
+	// the transport boundary rather than the hand-wrapped CSI types, so
+	// they're the right place for concerns like panic recovery, request
+	// logging, and metrics that should apply uniformly regardless of
+	// which Service ends up handling the call. See the gocsi/middleware
+	// subpackage for ready-made ones.
+	UnaryInterceptors []grpc.UnaryServerInterceptor
+
+	e  chan error
+	g  *grpc.Server
+	s  *server
+	l  net.Listener
+	hs []*http.Server
+	x  []func()
+
+	wg       sync.WaitGroup
+	done     chan struct{}
+	doneOnce sync.Once
+	serveErr error
 }
 
 type server struct {
 	s *Server
 }
 
-// Serve accepts incoming connections on the provided listener.
-// If no listener is provided then the server will create a
-// listener using s.Addr.
-//
-// Serve always returns a non-nil error.
-func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+// Start wires up the listener, the Services, and the gRPC server, then
+// returns immediately - it does not block waiting for the server to
+// exit. Callers that need to block should call Wait, or use Serve, which
+// is Start followed by Wait.
+func (s *Server) Start(ctx context.Context, l net.Listener) error {
 
 	if len(s.Services) == 0 {
 		return ErrEmptyServices
 	}
 
+	s.done = make(chan struct{})
+
 	// if the provided listener is nil then create one
 	// using s.Addr.
 	if l == nil {
@@ -72,44 +105,106 @@ func (s *Server) Serve(ctx context.Context, l net.Listener) error {
 	s.Addr = fmt.Sprintf("%s:/%s", netw, addr)
 
 	// if the listener is a unix socket then append an exit
-	// handler to remove the socket file
+	// handler to remove the socket file. it only runs after Wait
+	// returns, so it can never race an in-flight RPC's use of the
+	// socket file.
 	if netw == "unix" {
 		s.x = append(s.x, func() { os.RemoveAll(addr) })
 	}
 
+	// bring up the metrics/liveness sidecar, if configured, before the
+	// primary listener so a probe issued immediately after Start
+	// returns sees a ready endpoint
+	if err := s.ServeHealth(ctx); err != nil {
+		return err
+	}
+
 	// create the internal server
 	s.s = &server{s: s}
 
 	// create a new gRPC server and register this object
 	// as the handler for the CSI services
-	s.g = grpc.NewServer(s.Options...)
+	opts := s.Options
+	if len(s.UnaryInterceptors) > 0 {
+		opts = append(opts, grpc.UnaryInterceptor(chainUnaryInterceptors(s.UnaryInterceptors)))
+	}
+	s.g = grpc.NewServer(opts...)
 	csi.RegisterControllerServer(s.g, s.s)
 	csi.RegisterIdentityServer(s.g, s.s)
 	csi.RegisterNodeServer(s.g, s.s)
 
-	// start each of the Services
-	s.e = make(chan error)
+	// always register the NodeControllerNotify sidecar so a Node- or
+	// Controller-side NotifyClient elsewhere can reach this Server's
+	// NotifyReceiver Services, regardless of whether any are registered
+	s.g.RegisterService(&notifyServiceDesc, &notifyServerImpl{s: s})
+
+	// start each of the Services, tracked by s.wg so Stop/GracefulStop
+	// can block until every one of them has actually exited. s.e is
+	// buffered to hold one error per Service so a send here never
+	// blocks on ServiceErrs being drained - nothing requires a caller
+	// to read from it for Stop/GracefulStop/Wait to complete.
+	s.e = make(chan error, len(s.Services))
+	s.wg.Add(1)
 	go func(services []Service) {
-		var wg sync.WaitGroup
+		defer s.wg.Done()
+		var svcWG sync.WaitGroup
 		for _, svc := range services {
-			wg.Add(1)
+			svcWG.Add(1)
 			go func(svc Service) {
+				defer svcWG.Done()
 				s.e <- svc.Serve(ctx, nil)
-				wg.Done()
 			}(svc)
 		}
-		wg.Wait()
+		svcWG.Wait()
 		close(s.e)
 	}(s.Services)
 
-	// start accepting incoming gRPC connections
-	return s.g.Serve(l)
+	// start accepting incoming gRPC connections in the background;
+	// Wait/Done report when this, and everything above, has exited
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.serveErr = s.g.Serve(l)
+	}()
+
+	go func() {
+		s.wg.Wait()
+		s.doneOnce.Do(func() { close(s.done) })
+	}()
+
+	return nil
+}
+
+// Done returns a channel that is closed once the gRPC server, every
+// Service goroutine, and the metrics/liveness sidecar have all exited.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait blocks until Done is closed and returns the error the gRPC server
+// exited with.
+func (s *Server) Wait() error {
+	<-s.done
+	return s.serveErr
+}
+
+// Serve accepts incoming connections on the provided listener.
+// If no listener is provided then the server will create a
+// listener using s.Addr.
+//
+// Serve always returns a non-nil error. It is equivalent to calling
+// Start followed by Wait.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	if err := s.Start(ctx, l); err != nil {
+		return err
+	}
+	return s.Wait()
 }
 
 // ServiceErrs returns a channel that receives the errors
 // returned from the Services Serve functions. This channel
 // is closed when all of the Services have been stopped.
-func (s *Server) ServiceErrs() chan<- error {
+func (s *Server) ServiceErrs() <-chan error {
 	return s.e
 }
 
@@ -117,12 +212,20 @@ func (s *Server) ServiceErrs() chan<- error {
 // connections and listeners. It cancels all active RPCs on the
 // server side and the corresponding pending RPCs on the client
 // side will get notified by connection errors.
+//
+// Stop does not return until every Service goroutine and the gRPC serve
+// loop have actually exited, so the exit handlers registered by Start -
+// e.g. removing a unix socket file - can never race an in-flight RPC.
 func (s *Server) Stop(ctx context.Context) {
 	// stop each of the Services
 	for _, svc := range s.Services {
 		svc.Stop(ctx)
 	}
 	s.g.Stop()
+	for _, hs := range s.hs {
+		hs.Close()
+	}
+	s.Wait()
 	for _, x := range s.x {
 		x()
 	}
@@ -131,17 +234,46 @@ func (s *Server) Stop(ctx context.Context) {
 // GracefulStop stops the gRPC server gracefully. It stops the
 // server from accepting new connections and RPCs and blocks
 // until all the pending RPCs are finished.
+//
+// Like Stop, GracefulStop waits for every Service goroutine and the gRPC
+// serve loop to exit before running the exit handlers registered by
+// Start.
 func (s *Server) GracefulStop(ctx context.Context) {
 	// stop each of the Services
 	for _, svc := range s.Services {
 		svc.GracefulStop(ctx)
 	}
 	s.g.GracefulStop()
+	for _, hs := range s.hs {
+		hs.Close()
+	}
+	s.Wait()
 	for _, x := range s.x {
 		x()
 	}
 }
 
+// chainUnaryInterceptors composes interceptors into a single
+// grpc.UnaryServerInterceptor that invokes them in order, each wrapping
+// the next, with handler as the innermost call. It is the
+// grpc.UnaryServerInterceptor analog of chainInterceptors in
+// interceptor.go.
+func chainUnaryInterceptors(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			ic, cur := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return ic(ctx, req, info, cur)
+			}
+		}
+		return next(ctx, req)
+	}
+}
+
 type csisvc interface {
 	csi.ControllerServer
 	csi.IdentityServer
@@ -182,7 +314,8 @@ func (s *server) CreateVolume(
 	req *csi.CreateVolumeRequest) (
 	*csi.CreateVolumeResponse, error) {
 
-	return s.svcFromCtx(ctx).CreateVolume(ctx, req)
+	resp, err := s.svcFromCtx(ctx).CreateVolume(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 func (s *server) DeleteVolume(
@@ -190,7 +323,8 @@ func (s *server) DeleteVolume(
 	req *csi.DeleteVolumeRequest) (
 	*csi.DeleteVolumeResponse, error) {
 
-	return s.svcFromCtx(ctx).DeleteVolume(ctx, req)
+	resp, err := s.svcFromCtx(ctx).DeleteVolume(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 func (s *server) ControllerPublishVolume(
@@ -198,7 +332,8 @@ func (s *server) ControllerPublishVolume(
 	req *csi.ControllerPublishVolumeRequest) (
 	*csi.ControllerPublishVolumeResponse, error) {
 
-	return s.svcFromCtx(ctx).ControllerPublishVolume(ctx, req)
+	resp, err := s.svcFromCtx(ctx).ControllerPublishVolume(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 func (s *server) ControllerUnpublishVolume(
@@ -206,7 +341,8 @@ func (s *server) ControllerUnpublishVolume(
 	req *csi.ControllerUnpublishVolumeRequest) (
 	*csi.ControllerUnpublishVolumeResponse, error) {
 
-	return s.svcFromCtx(ctx).ControllerUnpublishVolume(ctx, req)
+	resp, err := s.svcFromCtx(ctx).ControllerUnpublishVolume(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 func (s *server) ValidateVolumeCapabilities(
@@ -214,7 +350,8 @@ func (s *server) ValidateVolumeCapabilities(
 	req *csi.ValidateVolumeCapabilitiesRequest) (
 	*csi.ValidateVolumeCapabilitiesResponse, error) {
 
-	return s.svcFromCtx(ctx).ValidateVolumeCapabilities(ctx, req)
+	resp, err := s.svcFromCtx(ctx).ValidateVolumeCapabilities(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 func (s *server) ListVolumes(
@@ -222,7 +359,8 @@ func (s *server) ListVolumes(
 	req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse, error) {
 
-	return s.svcFromCtx(ctx).ListVolumes(ctx, req)
+	resp, err := s.svcFromCtx(ctx).ListVolumes(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 func (s *server) GetCapacity(
@@ -230,7 +368,8 @@ func (s *server) GetCapacity(
 	req *csi.GetCapacityRequest) (
 	*csi.GetCapacityResponse, error) {
 
-	return s.svcFromCtx(ctx).GetCapacity(ctx, req)
+	resp, err := s.svcFromCtx(ctx).GetCapacity(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 func (s *server) ControllerGetCapabilities(
@@ -238,7 +377,17 @@ func (s *server) ControllerGetCapabilities(
 	req *csi.ControllerGetCapabilitiesRequest) (
 	*csi.ControllerGetCapabilitiesResponse, error) {
 
-	return s.svcFromCtx(ctx).ControllerGetCapabilities(ctx, req)
+	resp, err := s.svcFromCtx(ctx).ControllerGetCapabilities(ctx, req)
+	return resp, toStatusErr(err)
+}
+
+func (s *server) ControllerExpandVolume(
+	ctx context.Context,
+	req *csi.ControllerExpandVolumeRequest) (
+	*csi.ControllerExpandVolumeResponse, error) {
+
+	resp, err := s.svcFromCtx(ctx).ControllerExpandVolume(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -250,7 +399,8 @@ func (s *server) GetSupportedVersions(
 	req *csi.GetSupportedVersionsRequest) (
 	*csi.GetSupportedVersionsResponse, error) {
 
-	return s.svcFromCtx(ctx).GetSupportedVersions(ctx, req)
+	resp, err := s.svcFromCtx(ctx).GetSupportedVersions(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 func (s *server) GetPluginInfo(
@@ -258,7 +408,8 @@ func (s *server) GetPluginInfo(
 	req *csi.GetPluginInfoRequest) (
 	*csi.GetPluginInfoResponse, error) {
 
-	return s.svcFromCtx(ctx).GetPluginInfo(ctx, req)
+	resp, err := s.svcFromCtx(ctx).GetPluginInfo(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -270,7 +421,8 @@ func (s *server) NodePublishVolume(
 	req *csi.NodePublishVolumeRequest) (
 	*csi.NodePublishVolumeResponse, error) {
 
-	return s.svcFromCtx(ctx).NodePublishVolume(ctx, req)
+	resp, err := s.svcFromCtx(ctx).NodePublishVolume(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 func (s *server) NodeUnpublishVolume(
@@ -278,7 +430,8 @@ func (s *server) NodeUnpublishVolume(
 	req *csi.NodeUnpublishVolumeRequest) (
 	*csi.NodeUnpublishVolumeResponse, error) {
 
-	return s.svcFromCtx(ctx).NodeUnpublishVolume(ctx, req)
+	resp, err := s.svcFromCtx(ctx).NodeUnpublishVolume(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 func (s *server) GetNodeID(
@@ -286,7 +439,8 @@ func (s *server) GetNodeID(
 	req *csi.GetNodeIDRequest) (
 	*csi.GetNodeIDResponse, error) {
 
-	return s.svcFromCtx(ctx).GetNodeID(ctx, req)
+	resp, err := s.svcFromCtx(ctx).GetNodeID(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 func (s *server) ProbeNode(
@@ -294,7 +448,8 @@ func (s *server) ProbeNode(
 	req *csi.ProbeNodeRequest) (
 	*csi.ProbeNodeResponse, error) {
 
-	return s.svcFromCtx(ctx).ProbeNode(ctx, req)
+	resp, err := s.svcFromCtx(ctx).ProbeNode(ctx, req)
+	return resp, toStatusErr(err)
 }
 
 func (s *server) NodeGetCapabilities(
@@ -302,5 +457,15 @@ func (s *server) NodeGetCapabilities(
 	req *csi.NodeGetCapabilitiesRequest) (
 	*csi.NodeGetCapabilitiesResponse, error) {
 
-	return s.svcFromCtx(ctx).NodeGetCapabilities(ctx, req)
+	resp, err := s.svcFromCtx(ctx).NodeGetCapabilities(ctx, req)
+	return resp, toStatusErr(err)
+}
+
+func (s *server) NodeExpandVolume(
+	ctx context.Context,
+	req *csi.NodeExpandVolumeRequest) (
+	*csi.NodeExpandVolumeResponse, error) {
+
+	resp, err := s.svcFromCtx(ctx).NodeExpandVolume(ctx, req)
+	return resp, toStatusErr(err)
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"strings"
 	"sync"
 
@@ -63,6 +64,39 @@ type Service interface {
 
 	// Type returns the name of the service provider.
 	Type() string
+
+	// Dial returns a gRPC client connection to the service, routed over
+	// its in-memory PipeConn. This is the connection used internally by
+	// the Controller/Identity/Node RPC wrappers; it is exposed so
+	// external packages, such as gocsi/sanity, can issue their own CSI
+	// calls against the service without a TCP or UNIX listener.
+	Dial(ctx context.Context) (*grpc.ClientConn, error)
+
+	// NegotiatedVersion returns the version selected for the most
+	// recent successful RPC by the Service's VersionSelector. It is nil
+	// until the first successful RPC, and is most useful with the
+	// VersionHighestMutual policy, where it can differ from the literal
+	// version a caller sent.
+	NegotiatedVersion() *csi.Version
+
+	// ControllerOnly reports whether the underlying ServiceProvider
+	// implements ControllerOnlyProvider and declares itself as such. A
+	// caller such as Server's /readyz probe uses this to decide whether
+	// ProbeNode is even meaningful, rather than inferring it from
+	// NodeGetCapabilities, which a legitimate Node plugin can legally
+	// answer with zero capabilities.
+	ControllerOnly() bool
+}
+
+// ControllerOnlyProvider is optionally implemented by a ServiceProvider
+// that provides no Node service at all - as opposed to one that simply
+// advertises no optional Node capabilities, which NodeGetCapabilities
+// cannot tell apart from "no Node service" on its own. A provider that
+// doesn't implement it is assumed to be Node-capable.
+type ControllerOnlyProvider interface {
+	// ControllerOnly reports true if this provider is a Controller-only
+	// plugin with no Node service to probe.
+	ControllerOnly() bool
 }
 
 // NewService returns a service for the specified provider. If no
@@ -83,12 +117,18 @@ func NewService(
 		if strings.EqualFold(k, serviceType) {
 			o := v()
 			if sp, ok := o.(ServiceProvider); ok {
-				return &service{
+				s := &service{
 					serviceType: k,
 					serviceName: serviceName,
 					sp:          sp,
 					conn:        NewPipeConn(k),
-				}, nil
+					idempotency: NewIdempotencyCache(DefaultIdempotencyTTL),
+				}
+				s.interceptors = []Interceptor{
+					s.versionInterceptor, s.idempotencyInterceptor, tracingInterceptor, requestLoggingInterceptor,
+				}
+				s.rebuildDispatch()
+				return s, nil
 			}
 			return nil, fmt.Errorf("invalid service provider type: %T", o)
 		}
@@ -105,6 +145,54 @@ type service struct {
 	clnt         *grpc.ClientConn
 	versions     []*csi.Version
 	versionsOnce sync.Once
+
+	// interceptors is the chain every Controller/Identity/Node RPC is
+	// routed through. It always ends with the built-in version,
+	// idempotency, tracing, and logging interceptors; WithInterceptors
+	// prepends more, so user-supplied ones run outermost.
+	interceptors []Interceptor
+
+	// dispatch is interceptors composed into a single call, rebuilt
+	// whenever interceptors changes.
+	dispatch func(ctx context.Context, rpc string, req interface{}, invoke Invoker) (interface{}, error)
+
+	// versionSelector is consulted by chkReqVersion, which defaults to
+	// exact matching against GetSupportedVersions.
+	versionSelector VersionSelector
+
+	// negotiatedVersion is the version chosen for the most recent
+	// successful RPC, exposed so provider implementations can branch on
+	// it when VersionSelector has negotiated something newer than
+	// VersionExact would have allowed.
+	negotiatedVersion *csi.Version
+
+	// idempotency backs idempotencyInterceptor, deduplicating
+	// CreateVolume retries. NewService gives it DefaultIdempotencyTTL;
+	// WithIdempotencyTTL can override the TTL or disable it (nil).
+	idempotency *IdempotencyCache
+
+	// ephemeral tracks the volumes synthesized on behalf of inline
+	// ephemeral NodePublishVolume requests, so NodeUnpublishVolume can
+	// reverse them. It is created lazily on first use.
+	ephemeral     *ephemeralState
+	ephemeralOnce sync.Once
+}
+
+// ephemeralStateDir returns the directory NodePublish/NodeUnpublish use
+// to persist synthesized ephemeral volume state, defaulting to the
+// process's working directory.
+func (s *service) ephemeralStateDir() string {
+	if d := os.Getenv("X_CSI_EPHEMERAL_STATE_DIR"); d != "" {
+		return d
+	}
+	return "."
+}
+
+func (s *service) ephemeralStateStore() *ephemeralState {
+	s.ephemeralOnce.Do(func() {
+		s.ephemeral = newEphemeralState(s.ephemeralStateDir())
+	})
+	return s.ephemeral
 }
 
 func (s *service) Name() string {
@@ -115,6 +203,11 @@ func (s *service) Type() string {
 	return s.serviceType
 }
 
+func (s *service) ControllerOnly() bool {
+	co, ok := s.sp.(ControllerOnlyProvider)
+	return ok && co.ControllerOnly()
+}
+
 func (s *service) Serve(
 	ctx context.Context, lis net.Listener) (err error) {
 
@@ -144,6 +237,14 @@ func (s *service) dial(
 		grpc.WithDialer(s.conn.DialGrpc))
 }
 
+// Dial returns a gRPC client connection to the service, routed over its
+// in-memory PipeConn. It is exposed on the Service interface so external
+// packages, such as gocsi/sanity, can drive their own CSI calls against
+// the service without a TCP or UNIX listener.
+func (s *service) Dial(ctx context.Context) (*grpc.ClientConn, error) {
+	return s.dial(ctx)
+}
+
 func (s *service) dialController(
 	ctx context.Context) (csi.ControllerClient, error) {
 
@@ -174,6 +275,32 @@ func (s *service) dialNode(
 	return csi.NewNodeClient(c), nil
 }
 
+// hasControllerCapability reports whether the Controller service backing
+// s advertises the ControllerServiceCapability_RPC Type rpcType in
+// response to ControllerGetCapabilities. A dial or RPC failure is
+// treated as the capability not being advertised.
+func (s *service) hasControllerCapability(
+	ctx context.Context,
+	version *csi.Version,
+	rpcType csi.ControllerServiceCapability_RPC_Type) bool {
+
+	c, err := s.dialController(ctx)
+	if err != nil {
+		return false
+	}
+	resp, err := c.ControllerGetCapabilities(
+		ctx, &csi.ControllerGetCapabilitiesRequest{Version: version})
+	if err != nil {
+		return false
+	}
+	for _, cap := range resp.GetResult().GetCapabilities() {
+		if cap.GetRpc().GetType() == rpcType {
+			return true
+		}
+	}
+	return false
+}
+
 type hasGetVersion interface {
 	GetVersion() *csi.Version
 }
@@ -191,26 +318,18 @@ func (s *service) chkReqVersion(
 		return err.Error()
 	}
 
-	rv := req.GetVersion()
-	if rv == nil {
-		return "request version is nil"
-	}
-
-	for _, v := range s.versions {
-		if rv.GetMajor() != v.GetMajor() {
-			continue
-		}
-		if rv.GetMinor() != v.GetMinor() {
-			continue
-		}
-		if rv.GetPatch() != v.GetPatch() {
-			continue
-		}
-		return ""
+	negotiated, reason := s.versionSelector.Select(ctx, req.GetVersion(), s.versions)
+	if reason != "" {
+		return reason
 	}
+	s.negotiatedVersion = negotiated
+	return ""
+}
 
-	return fmt.Sprintf(
-		"unsupported request version: %s", SprintfVersion(rv))
+// NegotiatedVersion returns the version selected for the most recent
+// successful RPC.
+func (s *service) NegotiatedVersion() *csi.Version {
+	return s.negotiatedVersion
 }
 
 func (s *service) initSupportedVersionsOnce(ctx context.Context) (err error) {
@@ -258,19 +377,25 @@ func (s *service) CreateVolume(
 	req *csi.CreateVolumeRequest) (
 	*csi.CreateVolumeResponse, error) {
 
-	c, err := s.dialController(ctx)
-	if err != nil {
-		return nil, err
-	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrCreateVolumeGeneral(2, v), nil
-	}
 	if len(req.GetName()) == 0 {
 		// INVALID_VOLUME_NAME
 		return ErrCreateVolume(3, "missing name"), nil
 	}
-	return c.CreateVolume(ctx, req)
+	resp, err := s.dispatch(ctx, "CreateVolume", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialController(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.CreateVolume(ctx, req.(*csi.CreateVolumeRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrCreateVolumeGeneral(2, verr.reason), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*csi.CreateVolumeResponse), nil
 }
 
 func (s *service) DeleteVolume(
@@ -290,15 +415,21 @@ func (s *service) DeleteVolume(
 		return ErrDeleteVolume(3, "missing id map"), nil
 	}
 
-	c, err := s.dialController(ctx)
+	resp, err := s.dispatch(ctx, "DeleteVolume", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialController(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.DeleteVolume(ctx, req.(*csi.DeleteVolumeRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrDeleteVolumeGeneral(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrDeleteVolumeGeneral(2, v), nil
-	}
-	return c.DeleteVolume(ctx, req)
+	return resp.(*csi.DeleteVolumeResponse), nil
 }
 
 func (s *service) ControllerPublishVolume(
@@ -318,15 +449,21 @@ func (s *service) ControllerPublishVolume(
 		return ErrControllerPublishVolume(3, "missing id map"), nil
 	}
 
-	c, err := s.dialController(ctx)
+	resp, err := s.dispatch(ctx, "ControllerPublishVolume", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialController(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.ControllerPublishVolume(ctx, req.(*csi.ControllerPublishVolumeRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrControllerPublishVolumeGeneral(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrControllerPublishVolumeGeneral(2, v), nil
-	}
-	return c.ControllerPublishVolume(ctx, req)
+	return resp.(*csi.ControllerPublishVolumeResponse), nil
 }
 
 func (s *service) ControllerUnpublishVolume(
@@ -346,15 +483,21 @@ func (s *service) ControllerUnpublishVolume(
 		return ErrControllerUnpublishVolume(3, "missing id map"), nil
 	}
 
-	c, err := s.dialController(ctx)
+	resp, err := s.dispatch(ctx, "ControllerUnpublishVolume", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialController(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.ControllerUnpublishVolume(ctx, req.(*csi.ControllerUnpublishVolumeRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrControllerUnpublishVolumeGeneral(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrControllerUnpublishVolumeGeneral(2, v), nil
-	}
-	return c.ControllerUnpublishVolume(ctx, req)
+	return resp.(*csi.ControllerUnpublishVolumeResponse), nil
 }
 
 func (s *service) ValidateVolumeCapabilities(
@@ -362,15 +505,21 @@ func (s *service) ValidateVolumeCapabilities(
 	req *csi.ValidateVolumeCapabilitiesRequest) (
 	*csi.ValidateVolumeCapabilitiesResponse, error) {
 
-	c, err := s.dialController(ctx)
+	resp, err := s.dispatch(ctx, "ValidateVolumeCapabilities", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialController(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.ValidateVolumeCapabilities(ctx, req.(*csi.ValidateVolumeCapabilitiesRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrValidateVolumeCapabilitiesGeneral(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrValidateVolumeCapabilitiesGeneral(2, v), nil
-	}
-	return c.ValidateVolumeCapabilities(ctx, req)
+	return resp.(*csi.ValidateVolumeCapabilitiesResponse), nil
 }
 
 func (s *service) ListVolumes(
@@ -378,15 +527,21 @@ func (s *service) ListVolumes(
 	req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse, error) {
 
-	c, err := s.dialController(ctx)
+	resp, err := s.dispatch(ctx, "ListVolumes", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialController(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.ListVolumes(ctx, req.(*csi.ListVolumesRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrListVolumes(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrListVolumes(2, v), nil
-	}
-	return c.ListVolumes(ctx, req)
+	return resp.(*csi.ListVolumesResponse), nil
 }
 
 func (s *service) GetCapacity(
@@ -394,15 +549,21 @@ func (s *service) GetCapacity(
 	req *csi.GetCapacityRequest) (
 	*csi.GetCapacityResponse, error) {
 
-	c, err := s.dialController(ctx)
+	resp, err := s.dispatch(ctx, "GetCapacity", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialController(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.GetCapacity(ctx, req.(*csi.GetCapacityRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrGetCapacity(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrGetCapacity(2, v), nil
-	}
-	return c.GetCapacity(ctx, req)
+	return resp.(*csi.GetCapacityResponse), nil
 }
 
 func (s *service) ControllerGetCapabilities(
@@ -410,15 +571,55 @@ func (s *service) ControllerGetCapabilities(
 	req *csi.ControllerGetCapabilitiesRequest) (
 	*csi.ControllerGetCapabilitiesResponse, error) {
 
-	c, err := s.dialController(ctx)
+	resp, err := s.dispatch(ctx, "ControllerGetCapabilities", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialController(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.ControllerGetCapabilities(ctx, req.(*csi.ControllerGetCapabilitiesRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrControllerGetCapabilities(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrControllerGetCapabilities(2, v), nil
+	return resp.(*csi.ControllerGetCapabilitiesResponse), nil
+}
+
+func (s *service) ControllerExpandVolume(
+	ctx context.Context,
+	req *csi.ControllerExpandVolumeRequest) (
+	*csi.ControllerExpandVolumeResponse, error) {
+
+	idObj := req.GetVolumeId()
+	if idObj == nil {
+		// INVALID_VOLUME_ID
+		return ErrControllerExpandVolume(3, "missing id obj"), nil
+	}
+
+	idVals := idObj.GetValues()
+	if len(idVals) == 0 {
+		// INVALID_VOLUME_ID
+		return ErrControllerExpandVolume(3, "missing id map"), nil
 	}
-	return c.ControllerGetCapabilities(ctx, req)
+
+	resp, err := s.dispatch(ctx, "ControllerExpandVolume", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialController(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.ControllerExpandVolume(ctx, req.(*csi.ControllerExpandVolumeRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrControllerExpandVolumeGeneral(2, verr.reason), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*csi.ControllerExpandVolumeResponse), nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -447,15 +648,21 @@ func (s *service) GetPluginInfo(
 	req *csi.GetPluginInfoRequest) (
 	*csi.GetPluginInfoResponse, error) {
 
-	c, err := s.dialIdentity(ctx)
+	resp, err := s.dispatch(ctx, "GetPluginInfo", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialIdentity(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.GetPluginInfo(ctx, req.(*csi.GetPluginInfoRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrGetPluginInfo(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrGetPluginInfo(2, v), nil
-	}
-	return c.GetPluginInfo(ctx, req)
+	return resp.(*csi.GetPluginInfoResponse), nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -467,6 +674,34 @@ func (s *service) NodePublishVolume(
 	req *csi.NodePublishVolumeRequest) (
 	*csi.NodePublishVolumeResponse, error) {
 
+	// an ephemeral inline volume request carries no prior
+	// ControllerPublish; if the underlying provider opts in via
+	// EphemeralProvider, and its Controller advertises
+	// CREATE_DELETE_VOLUME, synthesize the volume here and track it so
+	// NodeUnpublishVolume can reverse the chain. Otherwise the CO falls
+	// back to its own node-local provisioning.
+	if isEphemeralRequest(req) && req.GetVolumeId() == nil {
+		ep, ok := s.sp.(EphemeralProvider)
+		if ok {
+			ok = s.hasControllerCapability(
+				ctx, req.GetVersion(), controllerCapabilityCreateDeleteVolume)
+		}
+		if !ok {
+			// MISSING_REQUIRED_FIELD
+			return ErrNodePublishVolumeGeneral(
+				3, "ephemeral volumes not supported by this provider"), nil
+		}
+		id, err := ep.SynthesizeEphemeralVolume(ctx, req)
+		if err != nil {
+			// UNDEFINED
+			return ErrNodePublishVolumeGeneral(1, err.Error()), nil
+		}
+		if err := s.ephemeralStateStore().record(req.GetTargetPath(), id); err != nil {
+			return ErrNodePublishVolumeGeneral(1, err.Error()), nil
+		}
+		req.VolumeId = id
+	}
+
 	idObj := req.GetVolumeId()
 	if idObj == nil {
 		// MISSING_REQUIRED_FIELD
@@ -479,15 +714,21 @@ func (s *service) NodePublishVolume(
 		return ErrNodePublishVolumeGeneral(3, "missing id map"), nil
 	}
 
-	c, err := s.dialNode(ctx)
+	resp, err := s.dispatch(ctx, "NodePublishVolume", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialNode(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.NodePublishVolume(ctx, req.(*csi.NodePublishVolumeRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrNodePublishVolumeGeneral(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrNodePublishVolumeGeneral(2, v), nil
-	}
-	return c.NodePublishVolume(ctx, req)
+	return resp.(*csi.NodePublishVolumeResponse), nil
 }
 
 func (s *service) NodeUnpublishVolume(
@@ -495,6 +736,20 @@ func (s *service) NodeUnpublishVolume(
 	req *csi.NodeUnpublishVolumeRequest) (
 	*csi.NodeUnpublishVolumeResponse, error) {
 
+	// recover the volume id synthesized for an ephemeral inline volume,
+	// if NodePublishVolume recorded one for this target path.
+	var ephemeralID *csi.VolumeID
+	if req.GetVolumeId() == nil {
+		id, err := s.ephemeralStateStore().lookup(req.GetTargetPath())
+		if err != nil {
+			return ErrNodeUnpublishVolumeGeneral(1, err.Error()), nil
+		}
+		if id != nil {
+			ephemeralID = id
+			req.VolumeId = id
+		}
+	}
+
 	idObj := req.GetVolumeId()
 	if idObj == nil {
 		// MISSING_REQUIRED_FIELD
@@ -507,15 +762,33 @@ func (s *service) NodeUnpublishVolume(
 		return ErrNodeUnpublishVolumeGeneral(3, "missing id map"), nil
 	}
 
-	c, err := s.dialNode(ctx)
+	resp, err := s.dispatch(ctx, "NodeUnpublishVolume", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialNode(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.NodeUnpublishVolume(ctx, req.(*csi.NodeUnpublishVolumeRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrNodeUnpublishVolumeGeneral(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrNodeUnpublishVolumeGeneral(2, v), nil
+
+	if ephemeralID != nil {
+		if ep, ok := s.sp.(EphemeralProvider); ok {
+			if err := ep.TeardownEphemeralVolume(ctx, ephemeralID); err != nil {
+				return ErrNodeUnpublishVolumeGeneral(1, err.Error()), nil
+			}
+		}
+		if err := s.ephemeralStateStore().forget(req.GetTargetPath()); err != nil {
+			return ErrNodeUnpublishVolumeGeneral(1, err.Error()), nil
+		}
 	}
-	return c.NodeUnpublishVolume(ctx, req)
+
+	return resp.(*csi.NodeUnpublishVolumeResponse), nil
 }
 
 func (s *service) GetNodeID(
@@ -523,15 +796,21 @@ func (s *service) GetNodeID(
 	req *csi.GetNodeIDRequest) (
 	*csi.GetNodeIDResponse, error) {
 
-	c, err := s.dialNode(ctx)
+	resp, err := s.dispatch(ctx, "GetNodeID", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialNode(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.GetNodeID(ctx, req.(*csi.GetNodeIDRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrGetNodeIDGeneral(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrGetNodeIDGeneral(2, v), nil
-	}
-	return c.GetNodeID(ctx, req)
+	return resp.(*csi.GetNodeIDResponse), nil
 }
 
 func (s *service) ProbeNode(
@@ -539,15 +818,21 @@ func (s *service) ProbeNode(
 	req *csi.ProbeNodeRequest) (
 	*csi.ProbeNodeResponse, error) {
 
-	c, err := s.dialNode(ctx)
+	resp, err := s.dispatch(ctx, "ProbeNode", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialNode(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.ProbeNode(ctx, req.(*csi.ProbeNodeRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrProbeNodeGeneral(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrProbeNodeGeneral(2, v), nil
-	}
-	return c.ProbeNode(ctx, req)
+	return resp.(*csi.ProbeNodeResponse), nil
 }
 
 func (s *service) NodeGetCapabilities(
@@ -555,13 +840,53 @@ func (s *service) NodeGetCapabilities(
 	req *csi.NodeGetCapabilitiesRequest) (
 	*csi.NodeGetCapabilitiesResponse, error) {
 
-	c, err := s.dialNode(ctx)
+	resp, err := s.dispatch(ctx, "NodeGetCapabilities", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialNode(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.NodeGetCapabilities(ctx, req.(*csi.NodeGetCapabilitiesRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrNodeGetCapabilities(2, verr.reason), nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if v := s.chkReqVersion(ctx, req); len(v) != 0 {
-		// UNSUPPORTED_REQUEST_VERSION
-		return ErrNodeGetCapabilities(2, v), nil
+	return resp.(*csi.NodeGetCapabilitiesResponse), nil
+}
+
+func (s *service) NodeExpandVolume(
+	ctx context.Context,
+	req *csi.NodeExpandVolumeRequest) (
+	*csi.NodeExpandVolumeResponse, error) {
+
+	idObj := req.GetVolumeId()
+	if idObj == nil {
+		// MISSING_REQUIRED_FIELD
+		return ErrNodeExpandVolumeGeneral(3, "missing id obj"), nil
+	}
+
+	idVals := idObj.GetValues()
+	if len(idVals) == 0 {
+		// MISSING_REQUIRED_FIELD
+		return ErrNodeExpandVolumeGeneral(3, "missing id map"), nil
+	}
+
+	resp, err := s.dispatch(ctx, "NodeExpandVolume", req,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			c, err := s.dialNode(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.NodeExpandVolume(ctx, req.(*csi.NodeExpandVolumeRequest))
+		})
+	if verr, ok := err.(*versionError); ok {
+		return ErrNodeExpandVolumeGeneral(2, verr.reason), nil
+	}
+	if err != nil {
+		return nil, err
 	}
-	return c.NodeGetCapabilities(ctx, req)
+	return resp.(*csi.NodeExpandVolumeResponse), nil
 }
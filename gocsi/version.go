@@ -0,0 +1,138 @@
+package gocsi
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/peer"
+
+	"github.com/container-storage-interface/examples/gocsi/csi"
+)
+
+// VersionPolicy selects how a VersionSelector decides whether a
+// request's version is acceptable against the versions a
+// ServiceProvider advertises via GetSupportedVersions.
+type VersionPolicy int
+
+const (
+	// VersionExact requires the request's major/minor/patch triple to
+	// be an exact member of the supported versions list. This is the
+	// behavior chkReqVersion had before VersionSelector existed.
+	VersionExact VersionPolicy = iota
+
+	// VersionMinorCompatible accepts a request whose major matches a
+	// supported version and whose minor is less than or equal to the
+	// highest minor supported at that major, regardless of patch. This
+	// is the common "CO speaks a slightly newer, spec-compatible minor"
+	// case that VersionExact rejects. The selected version is the highest
+	// supported minor at or below the request's, so a request older than
+	// every supported minor at its major is rejected.
+	VersionMinorCompatible
+
+	// VersionHighestMutual behaves like VersionMinorCompatible on the
+	// first RPC from a given peer, but then records the negotiated
+	// version keyed by that peer (via peer.FromContext) so subsequent
+	// RPCs from the same connection skip the compatibility scan.
+	VersionHighestMutual
+)
+
+// VersionSelector validates a request's Version against the versions a
+// ServiceProvider supports, according to Policy.
+type VersionSelector struct {
+	Policy VersionPolicy
+
+	mu         sync.Mutex
+	negotiated map[string]*csi.Version
+}
+
+// Select returns the supported version matching rv according to
+// vs.Policy, along with a reason string. An empty reason string means
+// rv is acceptable; a non-empty one explains why it was rejected, in
+// the same form chkReqVersion has always returned.
+func (vs *VersionSelector) Select(
+	ctx context.Context,
+	rv *csi.Version,
+	supported []*csi.Version) (negotiated *csi.Version, reason string) {
+
+	if rv == nil {
+		return nil, "request version is nil"
+	}
+
+	switch vs.Policy {
+	case VersionHighestMutual:
+		if p, ok := peer.FromContext(ctx); ok {
+			vs.mu.Lock()
+			if v, ok := vs.negotiated[p.Addr.String()]; ok {
+				vs.mu.Unlock()
+				return v, ""
+			}
+			vs.mu.Unlock()
+		}
+		v, reason := selectMinorCompatible(rv, supported)
+		if reason == "" {
+			if p, ok := peer.FromContext(ctx); ok {
+				vs.mu.Lock()
+				if vs.negotiated == nil {
+					vs.negotiated = map[string]*csi.Version{}
+				}
+				vs.negotiated[p.Addr.String()] = v
+				vs.mu.Unlock()
+			}
+		}
+		return v, reason
+
+	case VersionMinorCompatible:
+		return selectMinorCompatible(rv, supported)
+
+	default:
+		return selectExact(rv, supported)
+	}
+}
+
+func selectExact(rv *csi.Version, supported []*csi.Version) (*csi.Version, string) {
+	for _, v := range supported {
+		if rv.GetMajor() == v.GetMajor() &&
+			rv.GetMinor() == v.GetMinor() &&
+			rv.GetPatch() == v.GetPatch() {
+			return v, ""
+		}
+	}
+	return nil, fmt.Sprintf(
+		"unsupported request version: %s", SprintfVersion(rv))
+}
+
+func selectMinorCompatible(rv *csi.Version, supported []*csi.Version) (*csi.Version, string) {
+	var (
+		best      *csi.Version
+		maxMinor  uint32
+		sawMajor  bool
+		bestMinor uint32
+	)
+
+	for _, v := range supported {
+		if v.GetMajor() != rv.GetMajor() {
+			continue
+		}
+		sawMajor = true
+		if v.GetMinor() > maxMinor {
+			maxMinor = v.GetMinor()
+		}
+		if v.GetMinor() <= rv.GetMinor() && v.GetMinor() >= bestMinor {
+			bestMinor = v.GetMinor()
+			best = v
+		}
+	}
+
+	if !sawMajor || rv.GetMinor() > maxMinor || best == nil {
+		// either nothing at this major was advertised, the requested
+		// minor is newer than anything advertised, or the major
+		// matches but nothing at or below the requested minor was
+		// advertised. None of those are safe to serve: negotiating a
+		// minor higher than the client asked for would let a provider
+		// use fields the client doesn't understand.
+		return nil, fmt.Sprintf(
+			"unsupported request version: %s", SprintfVersion(rv))
+	}
+	return best, ""
+}